@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/sector-f/failoverd/internal/clock"
+	"github.com/sector-f/failoverd/internal/events"
+	"github.com/sector-f/failoverd/internal/lua"
+	"github.com/sector-f/failoverd/internal/ping"
+)
+
+// eventRecorder adds events to the history, along with the statistics at that moment, and
+// passes them on to on_event. Events may be recorded by the script itself, while the Engine
+// is busy, so they are passed on by a separate goroutine.
+type eventRecorder struct {
+	history *events.History
+	pinger  *ping.Pinger
+	clock   clock.Clock
+	logger  *slog.Logger
+
+	pending chan events.Event
+}
+
+func newEventRecorder(history *events.History, pinger *ping.Pinger, clk clock.Clock, logger *slog.Logger) *eventRecorder {
+	return &eventRecorder{
+		history: history,
+		pinger:  pinger,
+		clock:   clk,
+		logger:  logger,
+		pending: make(chan events.Event, 64),
+	}
+}
+
+func (r *eventRecorder) RecordEvent(typ string, dst string, message string) {
+	ev := r.history.Add(events.Event{
+		Time:    r.clock.Now(),
+		Type:    typ,
+		Dst:     dst,
+		Message: message,
+		Stats:   r.pinger.Stats(),
+	})
+
+	select {
+	case r.pending <- ev:
+	default:
+		r.logger.Warn("on_event is not keeping up; not passing it an event", "id", ev.ID, "type", ev.Type)
+	}
+}
+
+// deliver passes recorded events to on_event until the Engine is closed
+func (r *eventRecorder) deliver(luaEngine *lua.Engine) {
+	for ev := range r.pending {
+		err := luaEngine.OnEvent(ev)
+		if err == lua.ErrClosed {
+			return
+		} else if err != nil {
+			r.logger.Error("callback failed", "callback", "on_event", "event", ev.ID, "err", err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sector-f/failoverd/internal/clock"
+	"github.com/sector-f/failoverd/internal/events"
+	"github.com/sector-f/failoverd/internal/lua"
+	"github.com/sector-f/failoverd/internal/ping"
+)
+
+const eventConfig = `
+ping_frequency = 1
+update_frequency = 1
+privileged = false
+num_seconds = 10
+probes = {
+	probe.new("192.168.0.1"),
+}
+
+function on_event(ev)
+	os.execute("event " .. ev.id .. " " .. ev.type .. " " .. ev.dst)
+end
+`
+
+func TestEventRecorder(t *testing.T) {
+	configFilename := filepath.Join(t.TempDir(), "config.lua")
+	err := os.WriteFile(configFilename, []byte(eventConfig), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions := make(chan string, 128)
+	luaEngine, err := lua.New(configFilename, lua.WithInterceptor(func(action string) { actions <- action }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer luaEngine.Close()
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+
+	clk := clock.NewFake(time.Unix(1000, 0))
+	p := ping.NewReplayPinger(luaEngine.Config.Probes, ping.WithClock(clk))
+	p.Replay(ping.Result{Time: clk.Now(), Dst: "192.168.0.1", Success: true, RTT: 10 * time.Millisecond})
+
+	history := events.NewHistory(100)
+	recorder := newEventRecorder(history, p, clk, logger)
+
+	// Nothing is delivering events yet, so once the queue is full, events are only added to the history
+	queued := cap(recorder.pending)
+	for i := 0; i < queued+1; i++ {
+		recorder.RecordEvent(events.ProbeStarted, "192.168.0.1", "")
+	}
+
+	recorded := history.Events()
+	if len(recorded) != queued+1 {
+		t.Fatalf("Expected %d events in the history, got %d", queued+1, len(recorded))
+	}
+	if _, ok := recorded[0].Stats.Get("192.168.0.1"); !ok {
+		t.Errorf("Event is missing the probe's statistics")
+	}
+
+	dropped := fmt.Sprintf("id=%d", queued+1)
+	if !strings.Contains(logs.String(), "on_event is not keeping up") || !strings.Contains(logs.String(), dropped) {
+		t.Errorf("Dropped event was not logged: %s", logs.String())
+	}
+
+	go recorder.deliver(luaEngine)
+
+	for i := 1; i <= queued; i++ {
+		select {
+		case action := <-actions:
+			expected := fmt.Sprintf("os.execute event %d probe_started 192.168.0.1", i)
+			if action != expected {
+				t.Fatalf("Expected %q, got %q", expected, action)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Event %d was not passed to on_event", i)
+		}
+	}
+
+	select {
+	case action := <-actions:
+		t.Errorf("Dropped event was passed to on_event: %q", action)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
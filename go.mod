@@ -1,6 +1,6 @@
 module github.com/sector-f/failoverd
 
-go 1.19
+go 1.21
 
 require (
 	github.com/prometheus-community/pro-bing v0.1.0
@@ -11,7 +11,7 @@ require (
 require (
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/vishvananda/netns v0.0.0-20191106174202-0a2b9b5464df // indirect
-	golang.org/x/net v0.0.0-20220615171555-694bf12d69de // indirect
+	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sync v0.0.0-20220601150217-0de741cfad7f // indirect
-	golang.org/x/sys v0.0.0-20220615213510-4f61da869c0c // indirect
+	golang.org/x/sys v0.13.0 // indirect
 )
@@ -0,0 +1,150 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is a Clock whose time only changes when Advance or Set is called.
+type Fake struct {
+	now     time.Time
+	waiters []*fakeWaiter
+
+	mu sync.Mutex
+}
+
+// fakeWaiter is a fake Ticker (if period is non-zero) or Timer.
+type fakeWaiter struct {
+	clock    *Fake
+	deadline time.Time
+	period   time.Duration
+	c        chan time.Time
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{
+		now: now,
+	}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.now
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	return fakeTicker{f.addWaiter(d, d)}
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	return fakeTimer{f.addWaiter(d, 0)}
+}
+
+func (f *Fake) addWaiter(d time.Duration, period time.Duration) *fakeWaiter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w := &fakeWaiter{
+		clock:    f,
+		deadline: f.now.Add(d),
+		period:   period,
+		c:        make(chan time.Time, 1), // Buffered like the time package's channels
+	}
+	f.waiters = append(f.waiters, w)
+
+	return w
+}
+
+// Advance moves the clock forward by d, firing any tickers and timers that expire
+// along the way in the order that they expire.
+func (f *Fake) Advance(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+// Set moves the clock forward to t. It does nothing if t is before the current time.
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for {
+		next := f.nextWaiter()
+		if next == nil || next.deadline.After(t) {
+			break
+		}
+
+		f.now = next.deadline
+
+		// Like the time package, drop the tick if the previous one has not been received
+		select {
+		case next.c <- f.now:
+		default:
+		}
+
+		if next.period > 0 {
+			next.deadline = next.deadline.Add(next.period)
+		} else {
+			f.removeWaiter(next)
+		}
+	}
+
+	if t.After(f.now) {
+		f.now = t
+	}
+}
+
+// nextWaiter returns the waiter with the earliest deadline, or nil if there are none
+func (f *Fake) nextWaiter() *fakeWaiter {
+	var next *fakeWaiter
+	for _, w := range f.waiters {
+		if next == nil || w.deadline.Before(next.deadline) {
+			next = w
+		}
+	}
+
+	return next
+}
+
+// removeWaiter removes w, returning false if it had already been removed
+func (f *Fake) removeWaiter(w *fakeWaiter) bool {
+	for i := range f.waiters {
+		if f.waiters[i] == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (w *fakeWaiter) C() <-chan time.Time {
+	return w.c
+}
+
+func (w *fakeWaiter) stop() bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+
+	return w.clock.removeWaiter(w)
+}
+
+type fakeTicker struct {
+	*fakeWaiter
+}
+
+func (t fakeTicker) Stop() {
+	t.stop()
+}
+
+type fakeTimer struct {
+	*fakeWaiter
+}
+
+func (t fakeTimer) Stop() bool {
+	return t.stop()
+}
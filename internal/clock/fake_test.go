@@ -0,0 +1,80 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func expectTick(t *testing.T, c <-chan time.Time, expected time.Time) {
+	t.Helper()
+
+	select {
+	case tick := <-c:
+		if !tick.Equal(expected) {
+			t.Fatalf("Expected tick at %v, got %v", expected, tick)
+		}
+	default:
+		t.Fatalf("Expected tick at %v", expected)
+	}
+}
+
+func expectNoTick(t *testing.T, c <-chan time.Time) {
+	t.Helper()
+
+	select {
+	case tick := <-c:
+		t.Fatalf("Unexpected tick at %v", tick)
+	default:
+	}
+}
+
+func TestFakeTimer(t *testing.T) {
+	start := time.Unix(1000, 0)
+	f := NewFake(start)
+	timer := f.NewTimer(2 * time.Second)
+
+	f.Advance(1 * time.Second)
+	expectNoTick(t, timer.C())
+
+	f.Advance(1 * time.Second)
+	expectTick(t, timer.C(), start.Add(2*time.Second))
+
+	f.Advance(10 * time.Second)
+	expectNoTick(t, timer.C())
+
+	if timer.Stop() {
+		t.Fatalf("Expected Stop to return false for an expired timer")
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	start := time.Unix(1000, 0)
+	f := NewFake(start)
+	ticker := f.NewTicker(1 * time.Second)
+
+	f.Advance(1 * time.Second)
+	expectTick(t, ticker.C(), start.Add(1*time.Second))
+
+	// Ticks are dropped if they are not received, like time.Ticker
+	f.Advance(3 * time.Second)
+	expectTick(t, ticker.C(), start.Add(2*time.Second))
+	expectNoTick(t, ticker.C())
+
+	ticker.Stop()
+	f.Advance(1 * time.Second)
+	expectNoTick(t, ticker.C())
+
+	if !f.Now().Equal(start.Add(5 * time.Second)) {
+		t.Fatalf("Expected time to be %v, got %v", start.Add(5*time.Second), f.Now())
+	}
+}
+
+func TestFakeSetBackwards(t *testing.T) {
+	start := time.Unix(1000, 0)
+	f := NewFake(start)
+
+	f.Set(start.Add(-1 * time.Second))
+	if !f.Now().Equal(start) {
+		t.Fatalf("Expected time not to go backwards")
+	}
+}
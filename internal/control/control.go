@@ -0,0 +1,93 @@
+// Package control serves failoverd's control socket: a unix stream socket that answers
+// one-line commands with JSON, for inspecting a running daemon, e.g.
+//
+//	echo events | socat - UNIX-CONNECT:/run/failoverd/control.sock
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// commandTimeout limits how long a client has to send its command and read the reply
+const commandTimeout = 10 * time.Second
+
+// A Command answers a command sent to the control socket. Each of the values it returns is
+// written as JSON on a line of its own.
+type Command func() []interface{}
+
+// Server answers commands on the control socket.
+type Server struct {
+	listener net.Listener
+	commands map[string]Command
+}
+
+// Listen creates the control socket at path, replacing any left behind by a previous run.
+// commands maps the names of the commands it answers to their implementations.
+func Listen(path string, commands map[string]Command) (*Server, error) {
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		listener: listener,
+		commands: commands,
+	}, nil
+}
+
+// Serve accepts connections until the server is closed. Each connection sends a single command
+// and receives its reply.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		go s.handle(conn)
+	}
+}
+
+// Close stops the server and removes the socket.
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// handle reads a command and writes its reply as JSON Lines. Errors are written as {"error": "..."}.
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(commandTimeout))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+
+	enc := json.NewEncoder(conn)
+
+	name := strings.TrimSpace(line)
+	command, ok := s.commands[name]
+	if !ok {
+		enc.Encode(map[string]string{"error": "unknown command: " + name})
+		return
+	}
+
+	for _, v := range command() {
+		if enc.Encode(v) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/sector-f/failoverd/internal/events"
+)
+
+// command sends a command to the control socket and returns the lines of the reply
+func command(t *testing.T, path string, cmd string) []string {
+	t.Helper()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintln(conn, cmd)
+
+	lines := []string{}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	return lines
+}
+
+func TestEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+
+	history := events.NewHistory(10)
+	history.Add(events.Event{Type: events.ProbeStarted, Dst: "192.168.0.1"})
+	history.Add(events.Event{Type: events.CallbackError, Message: "oops"})
+
+	s, err := Listen(path, map[string]Command{
+		"events": func() []interface{} {
+			values := []interface{}{}
+			for _, ev := range history.Events() {
+				values = append(values, ev)
+			}
+			return values
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	lines := command(t, path, "events")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 events, got %q", lines)
+	}
+
+	var ev map[string]interface{}
+	err = json.Unmarshal([]byte(lines[1]), &ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ev["id"] != 2.0 || ev["type"] != events.CallbackError || ev["message"] != "oops" {
+		t.Errorf("Unexpected event: %s", lines[1])
+	}
+
+	lines = command(t, path, "bogus")
+	if len(lines) != 1 || lines[0] != `{"error":"unknown command: bogus"}` {
+		t.Errorf("Unexpected reply to unknown command: %q", lines)
+	}
+}
@@ -0,0 +1,82 @@
+// Package events keeps a history of the significant things failoverd does, such as starting
+// and stopping probes, so that decisions can be explained after the fact.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sector-f/failoverd/internal/ping"
+)
+
+// Types of events recorded by failoverd itself. Scripts may record events of any other type.
+const (
+	ProbeStarted  = "probe_started"
+	ProbeStopped  = "probe_stopped"
+	CallbackError = "callback_error"
+	StateRestored = "state_restored"
+)
+
+// DefaultHistorySize is the number of events kept by default.
+const DefaultHistorySize = 1000
+
+// Event is something significant that happened, along with the statistics at that moment.
+type Event struct {
+	ID      uint64        `json:"id"` // Increases by one with each event
+	Time    time.Time     `json:"time"`
+	Type    string        `json:"type"`
+	Dst     string        `json:"dst,omitempty"`     // The probe the event is about, if any
+	Message string        `json:"message,omitempty"` // e.g. the error for callback errors
+	Stats   ping.Snapshot `json:"stats"`
+}
+
+// History is a bounded, in-memory log of events. Once it is full, the oldest events are discarded.
+// It is safe for concurrent use.
+type History struct {
+	size   int
+	events []Event // Oldest first
+	nextID uint64
+
+	mu sync.Mutex
+}
+
+// NewHistory returns a History that keeps the given number of events.
+// If size is not positive, DefaultHistorySize is used.
+func NewHistory(size int) *History {
+	if size <= 0 {
+		size = DefaultHistorySize
+	}
+
+	return &History{
+		size:   size,
+		nextID: 1,
+	}
+}
+
+// Add adds an event to the history, returning it with its ID set.
+func (h *History) Add(ev Event) Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ev.ID = h.nextID
+	h.nextID++
+
+	if len(h.events) == h.size {
+		copy(h.events, h.events[1:])
+		h.events = h.events[:len(h.events)-1]
+	}
+	h.events = append(h.events, ev)
+
+	return ev
+}
+
+// Events returns the events in the history, oldest first.
+func (h *History) Events() []Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	events := make([]Event, len(h.events))
+	copy(events, h.events)
+
+	return events
+}
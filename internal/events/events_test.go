@@ -0,0 +1,24 @@
+package events
+
+import (
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	h := NewHistory(3)
+
+	for _, typ := range []string{"a", "b", "c", "d"} {
+		h.Add(Event{Type: typ})
+	}
+
+	events := h.Events()
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(events))
+	}
+
+	for i, expected := range []string{"b", "c", "d"} {
+		if events[i].Type != expected || events[i].ID != uint64(i+2) {
+			t.Errorf("Event %d: expected %s with ID %d, got %s with ID %d", i, expected, i+2, events[i].Type, events[i].ID)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"net"
+	"sync"
+)
+
+// datagramConn is a connection to a unix datagram socket, such as syslog's or journald's.
+// If a write fails, e.g. because the daemon has restarted and recreated its socket, it
+// re-dials once and retries, as log/syslog does. It is shared by a handler and the handlers
+// derived from it with WithAttrs and WithGroup.
+type datagramConn struct {
+	path string
+
+	mu     sync.Mutex
+	conn   net.Conn // nil if the last attempt to re-dial failed
+	closed bool
+}
+
+func dialDatagram(path string) (*datagramConn, error) {
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &datagramConn{path: path, conn: conn}, nil
+}
+
+// write sends b as a single datagram
+func (c *datagramConn) write(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	if c.conn != nil {
+		_, err := c.conn.Write(b)
+		if err == nil {
+			return nil
+		}
+
+		c.conn.Close()
+		c.conn = nil
+	}
+
+	conn, err := net.Dial("unixgram", c.path)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+
+	_, err = c.conn.Write(b)
+	return err
+}
+
+func (c *datagramConn) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	if c.conn == nil {
+		return nil
+	}
+
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// A field is an attribute flattened to a key and a string value
+type field struct {
+	key   string
+	value string
+}
+
+// fieldHandler implements the parts of slog.Handler shared by handlers that write records
+// as flat key/value fields: level filtering, and the attributes and groups added by
+// WithAttrs and WithGroup. Keys in groups are joined with sep, e.g. "request.url".
+type fieldHandler struct {
+	level  slog.Leveler
+	sep    string
+	prefix string  // Keys of attributes added later are prefixed with the open groups
+	fields []field // Fields added by WithAttrs
+}
+
+func (h fieldHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h fieldHandler) withAttrs(attrs []slog.Attr) fieldHandler {
+	fields := make([]field, len(h.fields), len(h.fields)+len(attrs))
+	copy(fields, h.fields)
+
+	for _, a := range attrs {
+		fields = h.appendAttr(fields, h.prefix, a)
+	}
+
+	h.fields = fields
+	return h
+}
+
+func (h fieldHandler) withGroup(name string) fieldHandler {
+	if name == "" {
+		return h
+	}
+
+	h.prefix += name + h.sep
+	return h
+}
+
+// recordFields returns the fields added by WithAttrs followed by those of the record
+func (h fieldHandler) recordFields(r slog.Record) []field {
+	fields := make([]field, len(h.fields), len(h.fields)+r.NumAttrs())
+	copy(fields, h.fields)
+
+	r.Attrs(func(a slog.Attr) bool {
+		fields = h.appendAttr(fields, h.prefix, a)
+		return true
+	})
+
+	return fields
+}
+
+func (h fieldHandler) appendAttr(fields []field, prefix string, a slog.Attr) []field {
+	a.Value = a.Value.Resolve()
+
+	if a.Equal(slog.Attr{}) {
+		return fields
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		// Attributes of groups with empty keys are inlined, as in slog's own handlers
+		if a.Key != "" {
+			prefix += a.Key + h.sep
+		}
+
+		for _, ga := range a.Value.Group() {
+			fields = h.appendAttr(fields, prefix, ga)
+		}
+		return fields
+	}
+
+	return append(fields, field{key: prefix + a.Key, value: valueString(a.Value)})
+}
+
+// valueString formats a value. Errors use their message, and other values without
+// a natural string form (e.g. maps and slices) are encoded as JSON.
+func valueString(v slog.Value) string {
+	if v.Kind() != slog.KindAny {
+		return v.String()
+	}
+
+	switch any := v.Any().(type) {
+	case error:
+		return any.Error()
+	case fmt.Stringer:
+		return any.String()
+	}
+
+	b, err := json.Marshal(v.Any())
+	if err != nil {
+		return fmt.Sprint(v.Any())
+	}
+
+	return string(b)
+}
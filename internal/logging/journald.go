@@ -0,0 +1,109 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// DefaultJournalSocket is the socket of journald's native protocol.
+const DefaultJournalSocket = "/run/systemd/journal/socket"
+
+// JournalHandler writes records to journald using its native protocol, so that each of
+// a record's attributes becomes a journal field, e.g. dst becomes DST.
+type JournalHandler struct {
+	fieldHandler
+
+	conn       *datagramConn
+	identifier string
+}
+
+// NewJournalHandler connects to journald's socket at path. Messages are logged with
+// the given SYSLOG_IDENTIFIER. If journald is restarted, the handler reconnects when it next logs.
+func NewJournalHandler(path string, identifier string, level slog.Leveler) (*JournalHandler, error) {
+	conn, err := dialDatagram(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to journald: %w", err)
+	}
+
+	return &JournalHandler{
+		fieldHandler: fieldHandler{level: level, sep: "_"},
+		conn:         conn,
+		identifier:   identifier,
+	}, nil
+}
+
+func (h *JournalHandler) Handle(_ context.Context, r slog.Record) error {
+	var b bytes.Buffer
+
+	writeJournalField(&b, "MESSAGE", r.Message)
+	writeJournalField(&b, "PRIORITY", fmt.Sprint(syslogSeverity(r.Level)))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", h.identifier)
+
+	for _, f := range h.recordFields(r) {
+		writeJournalField(&b, journalFieldName(f.key), f.value)
+	}
+
+	return h.conn.write(b.Bytes())
+}
+
+func (h *JournalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.fieldHandler = h.withAttrs(attrs)
+	return &h2
+}
+
+func (h *JournalHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.fieldHandler = h.withGroup(name)
+	return &h2
+}
+
+// Close closes the connection to journald.
+func (h *JournalHandler) Close() error {
+	return h.conn.close()
+}
+
+// writeJournalField writes a field in the native protocol's format: NAME=value, or if the value
+// contains a newline, the name followed by the value's length as a little-endian uint64
+func writeJournalField(b *bytes.Buffer, name string, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", name, value)
+		return
+	}
+
+	b.WriteString(name)
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// journalFieldName makes a key a valid journal field name: uppercase letters, digits and
+// underscores, not starting with an underscore (which is reserved for trusted fields) or a digit
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+
+	name = strings.TrimLeft(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "F_" + name
+	}
+
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	return name
+}
@@ -0,0 +1,59 @@
+// Package logging creates the structured loggers used throughout failoverd.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// appName identifies failoverd's messages in syslog and the journal
+const appName = "failoverd"
+
+// ParseLevel parses one of "debug", "info", "warn" or "error".
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q", s)
+	}
+}
+
+// NewHandler returns a handler that writes records at or above level to w, in the
+// given format: "text" (logfmt-style key=value pairs) or "json" (one object per line).
+func NewHandler(w io.Writer, level slog.Leveler, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch format {
+	case "", "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// Open returns a handler for the named output: "stderr" (the default, in the given format),
+// "syslog" (RFC 5424 to the local syslog socket) or "journald" (journald's native protocol).
+func Open(output string, level slog.Leveler, format string) (slog.Handler, error) {
+	switch output {
+	case "", "stderr":
+		return NewHandler(os.Stderr, level, format)
+	case "syslog":
+		return NewSyslogHandler(DefaultSyslogSocket, appName, level)
+	case "journald":
+		return NewJournalHandler(DefaultJournalSocket, appName, level)
+	default:
+		return nil, fmt.Errorf("unknown log output %q", output)
+	}
+}
@@ -0,0 +1,195 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := map[string]slog.Level{
+		"debug":   slog.LevelDebug,
+		"INFO":    slog.LevelInfo,
+		"warn":    slog.LevelWarn,
+		"warning": slog.LevelWarn,
+		"error":   slog.LevelError,
+	}
+
+	for s, expected := range tests {
+		level, err := ParseLevel(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if level != expected {
+			t.Errorf("%s: expected %v, got %v", s, expected, level)
+		}
+	}
+
+	_, err := ParseLevel("loud")
+	if err == nil {
+		t.Error("Expected an error for an unknown level")
+	}
+}
+
+func TestJSONHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := NewHandler(&buf, slog.LevelInfo, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := slog.New(h)
+	logger.Debug("hidden")
+	logger.Info("probe started", "dst", "192.168.0.1")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 line, got %q", buf.String())
+	}
+
+	var rec map[string]interface{}
+	err = json.Unmarshal([]byte(lines[0]), &rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec["msg"] != "probe started" || rec["dst"] != "192.168.0.1" || rec["level"] != "INFO" {
+		t.Errorf("Unexpected record: %v", rec)
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	_, err := NewHandler(&bytes.Buffer{}, slog.LevelInfo, "xml")
+	if err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+// listen creates a unix datagram socket like those of syslog and journald
+func listen(t *testing.T) (*net.UnixConn, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "log.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn, path
+}
+
+func receive(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(buf[:n])
+}
+
+func TestSyslogHandler(t *testing.T) {
+	conn, path := listen(t)
+
+	h, err := NewSyslogHandler(path, "failoverd", slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	logger := slog.New(h).With("probe", "wan1").WithGroup("stats")
+	logger.Debug("hidden")
+	logger.Warn("uplink changed", "dst", "192.168.0.2", "note", `say "hi" [ok]`)
+
+	msg := receive(t, conn)
+
+	// daemon.warning is 3*8 + 4
+	expected := regexp.MustCompile(`^<28>1 \S+ \S+ failoverd \d+ - \[failoverd@32473 probe="wan1" stats.dst="192.168.0.2" stats.note="say \\"hi\\" \[ok\\]"\] uplink changed$`)
+	if !expected.MatchString(msg) {
+		t.Errorf("Unexpected message: %s", msg)
+	}
+}
+
+func TestJournalHandler(t *testing.T) {
+	conn, path := listen(t)
+
+	h, err := NewJournalHandler(path, "failoverd", slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	logger := slog.New(h)
+	logger.Error("callback failed", "dst", "192.168.0.2", "err", errors.New("line 1\nline 2"), "_private", 1)
+
+	msg := receive(t, conn)
+
+	var multiline bytes.Buffer
+	multiline.WriteString("ERR\n")
+	binary.Write(&multiline, binary.LittleEndian, uint64(len("line 1\nline 2")))
+	multiline.WriteString("line 1\nline 2\n")
+
+	expected := "MESSAGE=callback failed\n" +
+		"PRIORITY=3\n" +
+		"SYSLOG_IDENTIFIER=failoverd\n" +
+		"DST=192.168.0.2\n" +
+		multiline.String() +
+		"PRIVATE=1\n"
+
+	if msg != expected {
+		t.Errorf("Expected %q, got %q", expected, msg)
+	}
+}
+
+func TestSyslogHandlerReconnects(t *testing.T) {
+	conn, path := listen(t)
+
+	h, err := NewSyslogHandler(path, "failoverd", slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	logger := slog.New(h)
+	logger.Info("before restart")
+	if msg := receive(t, conn); !strings.HasSuffix(msg, " before restart") {
+		t.Fatalf("Unexpected message: %s", msg)
+	}
+
+	// Like a syslog daemon restarting, which removes and recreates its socket
+	conn.Close()
+	err = os.Remove(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	err = h.Handle(context.Background(), slog.NewRecord(time.Now(), slog.LevelInfo, "after restart", 0))
+	if err != nil {
+		t.Fatalf("Expected the handler to reconnect, got %v", err)
+	}
+
+	if msg := receive(t, conn); !strings.HasSuffix(msg, " after restart") {
+		t.Errorf("Unexpected message: %s", msg)
+	}
+}
@@ -0,0 +1,129 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultSyslogSocket is the local syslog daemon's socket.
+const DefaultSyslogSocket = "/dev/log"
+
+const (
+	syslogFacilityDaemon = 3
+
+	// syslogSDID identifies the structured data element holding a record's attributes.
+	// 32473 is the private enterprise number reserved for documentation (RFC 5612).
+	syslogSDID = "failoverd@32473"
+)
+
+// SyslogHandler writes records to a local syslog daemon's unix datagram socket in the
+// RFC 5424 format, with the records' attributes as structured data.
+type SyslogHandler struct {
+	fieldHandler
+
+	conn     *datagramConn
+	appName  string
+	hostname string
+}
+
+// NewSyslogHandler connects to the syslog socket at path. Messages are logged under
+// the given application name. If syslog is restarted, the handler reconnects when it next logs.
+func NewSyslogHandler(path string, appName string, level slog.Leveler) (*SyslogHandler, error) {
+	conn, err := dialDatagram(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to syslog: %w", err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	return &SyslogHandler{
+		fieldHandler: fieldHandler{level: level, sep: "."},
+		conn:         conn,
+		appName:      appName,
+		hostname:     hostname,
+	}, nil
+}
+
+func (h *SyslogHandler) Handle(_ context.Context, r slog.Record) error {
+	pri := syslogFacilityDaemon*8 + syslogSeverity(r.Level)
+
+	timestamp := "-"
+	if !r.Time.IsZero() {
+		timestamp = r.Time.Format(time.RFC3339Nano)
+	}
+
+	sd := "-"
+	if fields := h.recordFields(r); len(fields) > 0 {
+		var b strings.Builder
+		b.WriteString("[" + syslogSDID)
+		for _, f := range fields {
+			fmt.Fprintf(&b, " %s=\"%s\"", syslogParamName(f.key), syslogParamValue(f.value))
+		}
+		b.WriteString("]")
+		sd = b.String()
+	}
+
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d - %s %s", pri, timestamp, h.hostname, h.appName, os.Getpid(), sd, r.Message)
+
+	return h.conn.write([]byte(msg))
+}
+
+func (h *SyslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.fieldHandler = h.withAttrs(attrs)
+	return &h2
+}
+
+func (h *SyslogHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.fieldHandler = h.withGroup(name)
+	return &h2
+}
+
+// Close closes the connection to the syslog socket.
+func (h *SyslogHandler) Close() error {
+	return h.conn.close()
+}
+
+func syslogSeverity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3 // Error
+	case level >= slog.LevelWarn:
+		return 4 // Warning
+	case level >= slog.LevelInfo:
+		return 6 // Informational
+	default:
+		return 7 // Debug
+	}
+}
+
+// syslogParamName makes a key a valid SD-NAME: printable ASCII other than '=', ' ', ']' and '"',
+// at most 32 characters
+func syslogParamName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, key)
+
+	if len(name) > 32 {
+		name = name[:32]
+	}
+
+	return name
+}
+
+// syslogParamValue escapes '"', '\' and ']', as required in PARAM-VALUEs
+func syslogParamValue(value string) string {
+	return strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`).Replace(value)
+}
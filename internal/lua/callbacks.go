@@ -0,0 +1,234 @@
+package lua
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Error policies, which decide what happens when on_recv, on_update, on_quit or on_event fails.
+// Errors are counted under every policy.
+const (
+	OnErrorLog     = "log"     // The error is returned, for the caller to log
+	OnErrorCount   = "count"   // The error is only counted
+	OnErrorDisable = "disable" // As for "log", and the callback is no longer called after MaxFailures consecutive errors
+	OnErrorExit    = "exit"    // As for "log", and an error is sent on Fatal after MaxFailures consecutive errors
+)
+
+const (
+	DefaultCallbackTimeout     time.Duration = 0 // No limit, unless the script or a sandbox sets one
+	DefaultCallbackMaxFailures               = 3
+)
+
+// CallbackStats counts the calls to a callback and its errors.
+type CallbackStats struct {
+	Calls             uint64 `json:"calls"`
+	Errors            uint64 `json:"errors"`
+	ConsecutiveErrors uint64 `json:"consecutive_errors"`
+	LastError         string `json:"last_error,omitempty"`
+	Disabled          bool   `json:"disabled"` // Set by the "disable" policy
+}
+
+// callContext returns the context of the callback that is running, which is done once the
+// callback's timeout expires. Functions that block, such as exec.run, should give up when it is done.
+func callContext(l *lua.LState) context.Context {
+	if ctx := l.Context(); ctx != nil {
+		return ctx
+	}
+
+	return context.Background()
+}
+
+// registerCoroutines replaces coroutine.resume and coroutine.wrap with versions that run the
+// coroutine under the context of the callback resuming it. gopher-lua gives each coroutine the
+// context of the callback that created it, so one kept across callbacks would otherwise fail
+// once that callback had returned and its context was done.
+func registerCoroutines(l *lua.LState) {
+	module, ok := l.GetGlobal("coroutine").(*lua.LTable)
+	if !ok {
+		return
+	}
+	resume, okResume := module.RawGetString("resume").(*lua.LFunction)
+	wrap, okWrap := module.RawGetString("wrap").(*lua.LFunction)
+	if !okResume || !okWrap {
+		return
+	}
+
+	l.SetField(module, "resume", l.NewFunction(func(l *lua.LState) int {
+		adoptContext(l, l.CheckThread(1))
+		return resume.GFunction(l)
+	}))
+
+	l.SetField(module, "wrap", l.NewFunction(func(l *lua.LState) int {
+		// The original returns a function whose first upvalue is the new coroutine
+		wrap.GFunction(l)
+		wrapped := l.CheckFunction(-1)
+		l.Pop(1)
+
+		co, ok := wrapped.Upvalues[0].Value().(*lua.LState)
+		if !ok {
+			l.RaiseError("coroutine.wrap did not create a coroutine")
+			return 0
+		}
+
+		// wrapped reads the coroutine from the first upvalue of the function being called, so
+		// the replacement must have the same upvalue
+		l.Push(l.NewClosure(func(l *lua.LState) int {
+			adoptContext(l, co)
+			return wrapped.GFunction(l)
+		}, co))
+		return 1
+	}))
+}
+
+// adoptContext gives a coroutine that is about to be resumed the context of the state resuming it
+func adoptContext(l *lua.LState, co *lua.LState) {
+	if ctx := l.Context(); ctx != nil {
+		co.SetContext(ctx)
+	} else {
+		co.RemoveContext()
+	}
+}
+
+// withLimits runs fn, which calls into the Lua state, aborting it if it runs for longer than
+// the Engine's timeout, or if it exceeds the sandbox's instruction or memory limits
+func (e *Engine) withLimits(l *lua.LState, fn func() error) error {
+	limited := e.sandbox != nil && (e.sandbox.MaxInstructions > 0 || e.sandbox.MaxMemory > 0)
+	if e.timeout <= 0 && !limited {
+		return fn()
+	}
+
+	ctx, cancel := context.Background(), func() {}
+	if e.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+	}
+	defer cancel()
+
+	if limited {
+		sc := newSandboxContext(ctx, *e.sandbox)
+		defer sc.close()
+		ctx = sc
+	}
+
+	l.SetContext(ctx)
+	defer l.RemoveContext()
+
+	err := fn()
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s: %w", e.timeout, err)
+	}
+
+	return err
+}
+
+// CallbackStats returns the statistics of every callback that has been called, by name.
+// Timers and the callbacks of exec.run_async and http.request_async are counted as "timer",
+// "exec.run_async" and "http.request_async".
+func (e *Engine) CallbackStats() map[string]CallbackStats {
+	e.callbackMu.Lock()
+	defer e.callbackMu.Unlock()
+
+	stats := make(map[string]CallbackStats, len(e.callbackStats))
+	for name, cs := range e.callbackStats {
+		stats[name] = *cs
+	}
+
+	return stats
+}
+
+// Fatal receives an error once a callback has failed too many times under the "exit" policy.
+func (e *Engine) Fatal() <-chan error {
+	return e.fatal
+}
+
+// countCall updates the statistics of a callback after it has been called, returning them
+func (e *Engine) countCall(name string, err error) CallbackStats {
+	e.callbackMu.Lock()
+	defer e.callbackMu.Unlock()
+
+	cs, ok := e.callbackStats[name]
+	if !ok {
+		cs = &CallbackStats{}
+		e.callbackStats[name] = cs
+	}
+
+	cs.Calls++
+	if err == nil {
+		cs.ConsecutiveErrors = 0
+		return *cs
+	}
+
+	cs.Errors++
+	cs.ConsecutiveErrors++
+	cs.LastError = err.Error()
+
+	return *cs
+}
+
+func (e *Engine) disableCallback(name string) {
+	e.callbackMu.Lock()
+	defer e.callbackMu.Unlock()
+
+	e.callbackStats[name].Disabled = true
+}
+
+func (e *Engine) callbackDisabled(name string) bool {
+	e.callbackMu.Lock()
+	defer e.callbackMu.Unlock()
+
+	cs, ok := e.callbackStats[name]
+	return ok && cs.Disabled
+}
+
+// callback calls one of the script's callback functions on the dispatcher goroutine with the
+// arguments returned by args, and applies the error policy to the result
+func (e *Engine) callback(name string, fn lua.LValue, args func(l *lua.LState) []lua.LValue) error {
+	if fn.Type() == lua.LTNil || e.callbackDisabled(name) {
+		return nil
+	}
+
+	return e.do(func(l *lua.LState) error {
+		e.running = name
+		defer func() { e.running = "" }()
+
+		err := e.withLimits(l, func() error {
+			return l.CallByParam(
+				lua.P{
+					Fn:      fn,
+					NRet:    0,
+					Protect: true,
+				},
+				args(l)...,
+			)
+		})
+
+		if err != nil {
+			err = fmt.Errorf("error calling %s function: %w", name, err)
+		}
+
+		cs := e.countCall(name, err)
+		if err == nil {
+			return nil
+		}
+
+		policy := e.Config.Callbacks
+		failing := cs.ConsecutiveErrors >= uint64(policy.MaxFailures)
+
+		switch {
+		case policy.OnError == OnErrorCount:
+			return nil
+		case policy.OnError == OnErrorDisable && failing:
+			e.disableCallback(name)
+			e.logger().Warn("disabling callback after repeated errors", "callback", name, "errors", cs.ConsecutiveErrors)
+		case policy.OnError == OnErrorExit && failing:
+			select {
+			case e.fatal <- fmt.Errorf("%s failed %d times in a row: %w", name, cs.ConsecutiveErrors, err):
+			default:
+			}
+		}
+
+		return err
+	})
+}
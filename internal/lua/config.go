@@ -2,9 +2,14 @@ package lua
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/sector-f/failoverd/internal/events"
+	"github.com/sector-f/failoverd/internal/logging"
 	"github.com/sector-f/failoverd/internal/ping"
+	"github.com/sector-f/failoverd/internal/state"
 	lua "github.com/yuin/gopher-lua"
 )
 
@@ -13,92 +18,311 @@ type Config struct {
 	UpdateFrequency time.Duration
 	Privileged      bool
 	NumSeconds      uint
+	EWMAAlpha       float64
+	Windows         map[string]uint
 	Probes          []ping.Probe
+	Record          RecordConfig
+	Logging         LoggingConfig
+	State           StateConfig
+	EventHistory    int    // Number of events to keep
+	ControlSocket   string // Path of the control socket; disabled if empty
+	Callbacks       CallbacksConfig
+
+	probePositions []string // Where each probe was created in the script
 
 	onRecvFunc   lua.LValue
 	onUpdateFunc lua.LValue
 	onQuitFunc   lua.LValue
+	onEventFunc  lua.LValue
+}
+
+// RecordConfig specifies where raw probe results are recorded. Recording is disabled if Path is empty.
+type RecordConfig struct {
+	Configured bool // Whether the script has a `record` table, in which case a path must be given somewhere
+	Path       string
+	MaxSize    int64 // Bytes
+	MaxFiles   int
 }
 
-func configFromLua(l *lua.LState) (Config, error) {
+// StateConfig specifies where state is saved across restarts. Saving is disabled if Path is empty.
+type StateConfig struct {
+	Configured   bool // Whether the script has a `state` table, in which case a path must be given somewhere
+	Path         string
+	MaxAge       time.Duration // Saved state older than this is not restored. Zero means no limit.
+	SaveInterval time.Duration
+}
+
+// CallbacksConfig specifies how long callbacks may run and what happens when they fail.
+type CallbacksConfig struct {
+	Timeout     time.Duration // No limit if zero
+	OnError     string        // One of the OnError* policies
+	MaxFailures int           // Consecutive errors before the "disable" and "exit" policies act
+}
+
+// ConfigErrors lists every problem found in a configuration. Each error is prefixed with
+// the position in the script that it refers to.
+type ConfigErrors []error
+
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+// A configSource is where the settings are read from: either a configuration table, passed to
+// failoverd.setup or returned by the script, or the script's globals.
+type configSource struct {
+	l     *lua.LState
+	table *lua.LTable // nil if the settings are globals
+	pos   sourcePositions
+}
+
+func (s configSource) get(name string) lua.LValue {
+	if s.table != nil {
+		return s.table.RawGetString(name)
+	}
+
+	return s.l.GetGlobal(name)
+}
+
+// newConfigSource determines where the settings are read from after the script has been run.
+// returned is the script's first return value, or nil.
+func newConfigSource(l *lua.LState, configFile string, setup *lua.LTable, returned lua.LValue) (configSource, error) {
+	globals, fields := parsePositions(configFile)
+
+	returnedTable, isTable := returned.(*lua.LTable)
+	switch {
+	case setup != nil && isTable:
+		return configSource{}, fmt.Errorf("%s: the script must either call failoverd.setup or return a configuration table, not both", configFile)
+	case setup != nil:
+		return configSource{l: l, table: setup, pos: fields}, nil
+	case isTable:
+		return configSource{l: l, table: returnedTable, pos: fields}, nil
+	default:
+		return configSource{l: l, pos: globals}, nil
+	}
+}
+
+// LoggingConfig specifies how failoverd logs. Empty fields are left at their defaults.
+type LoggingConfig struct {
+	Level  string // "debug", "info", "warn" or "error"
+	Format string // "text" or "json"
+	Output string // "stderr", "syslog" or "journald"
+}
+
+// configFromLua reads the configuration from a configSource. All problems are collected,
+// and returned as ConfigErrors, rather than stopping at the first one.
+func configFromLua(src configSource) (Config, error) {
 	c := Config{}
+	errs := ConfigErrors{}
+	pos := src.pos
+
+	// addErr records an error about a setting, prefixed with the position at which it was set
+	addErr := func(name string, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s %s", pos.of(name), fmt.Sprintf(format, args...)))
+	}
 
-	switch pingFreq := l.GetGlobal("ping_frequency").(type) {
+	switch pingFreq := src.get("ping_frequency").(type) {
 	case lua.LNumber:
 		c.PingFrequency = time.Duration(float64(pingFreq) * float64(time.Second))
 	default:
-		return c, fmt.Errorf("`ping_frequency` must be a number, not a %s", pingFreq.Type())
+		addErr("ping_frequency", "`ping_frequency` must be a number, not a %s", pingFreq.Type())
 	}
 
-	switch updateFreq := l.GetGlobal("update_frequency").(type) {
+	switch updateFreq := src.get("update_frequency").(type) {
 	case lua.LNumber:
 		c.UpdateFrequency = time.Duration(float64(updateFreq) * float64(time.Second))
 	default:
-		return c, fmt.Errorf("`update_frequency` must be a number, not a %s", updateFreq.Type())
+		addErr("update_frequency", "`update_frequency` must be a number, not a %s", updateFreq.Type())
 	}
 
-	switch privileged := l.GetGlobal("privileged").(type) {
+	switch privileged := src.get("privileged").(type) {
 	case lua.LBool:
 		c.Privileged = bool(privileged)
 	default:
-		return c, fmt.Errorf("`privileged` must be a bool, not a %s", privileged.Type())
+		addErr("privileged", "`privileged` must be a bool, not a %s", privileged.Type())
 	}
 
-	switch numSeconds := l.GetGlobal("num_seconds").(type) {
+	switch numSeconds := src.get("num_seconds").(type) {
 	case lua.LNumber:
 		c.NumSeconds = uint(numSeconds)
 	default:
-		return c, fmt.Errorf("`num_seconds` must be a number, not a %s", numSeconds.Type())
+		addErr("num_seconds", "`num_seconds` must be a number, not a %s", numSeconds.Type())
+	}
+
+	switch ewmaAlpha := src.get("ewma_alpha").(type) {
+	case *lua.LNilType:
+		c.EWMAAlpha = ping.DefaultEWMAAlpha
+	case lua.LNumber:
+		if ewmaAlpha <= 0 || ewmaAlpha > 1 {
+			addErr("ewma_alpha", "`ewma_alpha` must be greater than 0 and at most 1")
+		}
+		c.EWMAAlpha = float64(ewmaAlpha)
+	default:
+		addErr("ewma_alpha", "`ewma_alpha` must be a number, not a %s", ewmaAlpha.Type())
+	}
+
+	switch windows := src.get("windows").(type) {
+	case *lua.LNilType:
+	case *lua.LTable:
+		w, windowErrs := windowsFromLua(windows)
+		for _, err := range windowErrs {
+			addErr("windows", "`windows`: %s", err)
+		}
+		c.Windows = w
+	default:
+		addErr("windows", "`windows` must be a table, not a %s", windows.Type())
 	}
 
-	switch probes := l.GetGlobal("probes").(type) {
+	switch probes := src.get("probes").(type) {
 	case *lua.LTable:
 		p := []ping.Probe{}
 
-		var err error = nil
 		probes.ForEach(
-			func(_ lua.LValue, val lua.LValue) {
+			func(key lua.LValue, val lua.LValue) {
+				// Items that are not probes are reported at their position in the `probes`
+				// table constructor, if there is one
+				where := pos.of("probes")
+				if i, ok := key.(lua.LNumber); ok {
+					where = pos.item("probes", int(i))
+				}
+
 				switch probeItem := val.(type) {
 				case *lua.LUserData:
 					switch probe := probeItem.Value.(type) {
-					case ping.Probe:
-						p = append(p, probe)
+					case luaProbe:
+						p = append(p, probe.Probe)
+						c.probePositions = append(c.probePositions, probe.where)
 					default:
-						err = fmt.Errorf("`probes` item must be a probe")
+						errs = append(errs, fmt.Errorf("%s `probes[%s]` must be a probe", where, key))
 					}
 				default:
-					err = fmt.Errorf("`probes` item must be a probe, not a %s", probeItem.Type())
+					errs = append(errs, fmt.Errorf("%s `probes[%s]` must be a probe, not a %s", where, key, probeItem.Type()))
 				}
 			},
 		)
-		if err != nil {
-			return c, err
-		}
 
 		c.Probes = p
 	default:
-		return c, fmt.Errorf("`probes` must be a table, not a %s", probes.Type())
+		addErr("probes", "`probes` must be a table, not a %s", probes.Type())
 	}
 
-	switch onRecvFunc := l.GetGlobal("on_recv").(type) {
+	switch record := src.get("record").(type) {
+	case *lua.LNilType:
+	case *lua.LTable:
+		r, recordErrs := recordConfigFromLua(record)
+		for _, err := range recordErrs {
+			addErr("record", "`record`: %s", err)
+		}
+		c.Record = r
+	default:
+		addErr("record", "`record` must be a table, not a %s", record.Type())
+	}
+
+	switch loggingConfig := src.get("logging").(type) {
+	case *lua.LNilType:
+	case *lua.LTable:
+		lc, loggingErrs := loggingConfigFromLua(loggingConfig)
+		for _, err := range loggingErrs {
+			addErr("logging", "`logging`: %s", err)
+		}
+		c.Logging = lc
+	default:
+		addErr("logging", "`logging` must be a table, not a %s", loggingConfig.Type())
+	}
+
+	// Defaults apply even without a `state` table, since the path can also be given on the command line
+	c.State = StateConfig{MaxAge: state.DefaultMaxAge, SaveInterval: state.DefaultSaveInterval}
+
+	switch stateConfig := src.get("state").(type) {
+	case *lua.LNilType:
+	case *lua.LTable:
+		sc, stateErrs := stateConfigFromLua(stateConfig)
+		for _, err := range stateErrs {
+			addErr("state", "`state`: %s", err)
+		}
+		c.State = sc
+	default:
+		addErr("state", "`state` must be a table, not a %s", stateConfig.Type())
+	}
+
+	switch eventHistory := src.get("event_history").(type) {
+	case *lua.LNilType:
+		c.EventHistory = events.DefaultHistorySize
+	case lua.LNumber:
+		if eventHistory < 1 {
+			addErr("event_history", "`event_history` must be at least 1")
+		}
+		c.EventHistory = int(eventHistory)
+	default:
+		addErr("event_history", "`event_history` must be a number, not a %s", eventHistory.Type())
+	}
+
+	switch controlSocket := src.get("control_socket").(type) {
+	case *lua.LNilType:
+	case lua.LString:
+		c.ControlSocket = string(controlSocket)
+	default:
+		addErr("control_socket", "`control_socket` must be a string, not a %s", controlSocket.Type())
+	}
+
+	c.Callbacks = CallbacksConfig{
+		Timeout:     DefaultCallbackTimeout,
+		OnError:     OnErrorLog,
+		MaxFailures: DefaultCallbackMaxFailures,
+	}
+
+	switch callbacks := src.get("callbacks").(type) {
+	case *lua.LNilType:
+	case *lua.LTable:
+		cc, callbackErrs := callbacksConfigFromLua(callbacks, c.Callbacks)
+		for _, err := range callbackErrs {
+			addErr("callbacks", "`callbacks`: %s", err)
+		}
+		c.Callbacks = cc
+	default:
+		addErr("callbacks", "`callbacks` must be a table, not a %s", callbacks.Type())
+	}
+
+	switch onRecvFunc := src.get("on_recv").(type) {
 	case *lua.LFunction, *lua.LNilType:
 		c.onRecvFunc = onRecvFunc
 	default:
-		return c, fmt.Errorf("`on_recv` must be a function, not a %s", onRecvFunc.Type())
+		addErr("on_recv", "`on_recv` must be a function, not a %s", onRecvFunc.Type())
 	}
 
-	switch onUpdateFunc := l.GetGlobal("on_update").(type) {
+	switch onUpdateFunc := src.get("on_update").(type) {
 	case *lua.LFunction, *lua.LNilType:
 		c.onUpdateFunc = onUpdateFunc
 	default:
-		return c, fmt.Errorf("`on_update` must be a function, not a %s", onUpdateFunc.Type())
+		addErr("on_update", "`on_update` must be a function, not a %s", onUpdateFunc.Type())
 	}
 
-	switch onQuitFunc := l.GetGlobal("on_quit").(type) {
+	switch onQuitFunc := src.get("on_quit").(type) {
 	case *lua.LFunction, *lua.LNilType:
 		c.onQuitFunc = onQuitFunc
 	default:
-		return c, fmt.Errorf("`on_quit` must be a function, not a %s", onQuitFunc.Type())
+		addErr("on_quit", "`on_quit` must be a function, not a %s", onQuitFunc.Type())
+	}
+
+	switch onEventFunc := src.get("on_event").(type) {
+	case *lua.LFunction, *lua.LNilType:
+		c.onEventFunc = onEventFunc
+	default:
+		addErr("on_event", "`on_event` must be a function, not a %s", onEventFunc.Type())
+	}
+
+	// failoverd has no probe groups, so a configuration table carries the same settings as the globals.
+	// A `groups` field is rejected rather than ignored, since a script that sets one expects it to do something.
+	if src.table != nil && src.get("groups") != lua.LNil {
+		addErr("groups", "`groups` is not supported; failoverd has no probe groups")
+	}
+
+	if len(errs) > 0 {
+		return c, errs
 	}
 
 	// Set defaults/overrides
@@ -117,3 +341,208 @@ func configFromLua(l *lua.LState) (Config, error) {
 
 	return c, nil
 }
+
+// CheckProbes validates every probe, including whether the interfaces given as sources exist.
+// Each error is prefixed with the position in the script at which the probe was created.
+func (c Config) CheckProbes() []error {
+	var errs []error
+
+	for i, probe := range c.Probes {
+		err := ping.ValidateProbe(probe)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s probe %s: %w", c.probePositions[i], probe.Dst, err))
+		}
+	}
+
+	return errs
+}
+
+// windowsFromLua converts a table mapping window names to lengths in seconds.
+// The errors are sorted, since the order in which tables are traversed is unspecified.
+func windowsFromLua(table *lua.LTable) (map[string]uint, []error) {
+	windows := make(map[string]uint)
+	errs := []error{}
+
+	table.ForEach(func(key lua.LValue, val lua.LValue) {
+		name, ok := key.(lua.LString)
+		if !ok {
+			errs = append(errs, fmt.Errorf("window names must be strings, not a %s", key.Type()))
+			return
+		}
+
+		seconds, ok := val.(lua.LNumber)
+		if !ok {
+			errs = append(errs, fmt.Errorf("window `%s` must be a number, not a %s", name, val.Type()))
+			return
+		}
+
+		if seconds < 1 {
+			errs = append(errs, fmt.Errorf("window `%s` must be at least 1 second long", name))
+			return
+		}
+
+		windows[string(name)] = uint(seconds)
+	})
+
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Error() < errs[j].Error()
+	})
+
+	return windows, errs
+}
+
+func recordConfigFromLua(table *lua.LTable) (RecordConfig, []error) {
+	r := RecordConfig{Configured: true}
+	errs := []error{}
+
+	// The path may instead be given on the command line, so whether one was given at all is checked by the caller
+	switch path := table.RawGetString("path").(type) {
+	case *lua.LNilType:
+	case lua.LString:
+		r.Path = string(path)
+	default:
+		errs = append(errs, fmt.Errorf("`path` must be a string, not a %s", path.Type()))
+	}
+
+	switch maxSize := table.RawGetString("max_size").(type) {
+	case *lua.LNilType:
+	case lua.LNumber:
+		r.MaxSize = int64(maxSize)
+	default:
+		errs = append(errs, fmt.Errorf("`max_size` must be a number, not a %s", maxSize.Type()))
+	}
+
+	switch maxFiles := table.RawGetString("max_files").(type) {
+	case *lua.LNilType:
+	case lua.LNumber:
+		r.MaxFiles = int(maxFiles)
+	default:
+		errs = append(errs, fmt.Errorf("`max_files` must be a number, not a %s", maxFiles.Type()))
+	}
+
+	return r, errs
+}
+
+func stateConfigFromLua(table *lua.LTable) (StateConfig, []error) {
+	sc := StateConfig{
+		Configured:   true,
+		MaxAge:       state.DefaultMaxAge,
+		SaveInterval: state.DefaultSaveInterval,
+	}
+	errs := []error{}
+
+	// The path may instead be given on the command line, so whether one was given at all is checked by the caller
+	switch path := table.RawGetString("path").(type) {
+	case *lua.LNilType:
+	case lua.LString:
+		sc.Path = string(path)
+	default:
+		errs = append(errs, fmt.Errorf("`path` must be a string, not a %s", path.Type()))
+	}
+
+	switch maxAge := table.RawGetString("max_age").(type) {
+	case *lua.LNilType:
+	case lua.LNumber:
+		if maxAge < 0 {
+			errs = append(errs, fmt.Errorf("`max_age` must not be negative"))
+		}
+		sc.MaxAge = time.Duration(float64(maxAge) * float64(time.Second))
+	default:
+		errs = append(errs, fmt.Errorf("`max_age` must be a number, not a %s", maxAge.Type()))
+	}
+
+	switch saveInterval := table.RawGetString("save_interval").(type) {
+	case *lua.LNilType:
+	case lua.LNumber:
+		if saveInterval <= 0 {
+			errs = append(errs, fmt.Errorf("`save_interval` must be positive"))
+		}
+		sc.SaveInterval = time.Duration(float64(saveInterval) * float64(time.Second))
+	default:
+		errs = append(errs, fmt.Errorf("`save_interval` must be a number, not a %s", saveInterval.Type()))
+	}
+
+	return sc, errs
+}
+
+func callbacksConfigFromLua(table *lua.LTable, cc CallbacksConfig) (CallbacksConfig, []error) {
+	errs := []error{}
+
+	switch timeout := table.RawGetString("timeout").(type) {
+	case *lua.LNilType:
+	case lua.LNumber:
+		if timeout < 0 {
+			errs = append(errs, fmt.Errorf("`timeout` must not be negative"))
+		}
+		cc.Timeout = time.Duration(float64(timeout) * float64(time.Second))
+	default:
+		errs = append(errs, fmt.Errorf("`timeout` must be a number, not a %s", timeout.Type()))
+	}
+
+	switch onError := table.RawGetString("on_error").(type) {
+	case *lua.LNilType:
+	case lua.LString:
+		switch onError {
+		case OnErrorLog, OnErrorCount, OnErrorDisable, OnErrorExit:
+		default:
+			errs = append(errs, fmt.Errorf("`on_error` must be \"log\", \"count\", \"disable\" or \"exit\", not %q", onError))
+		}
+		cc.OnError = string(onError)
+	default:
+		errs = append(errs, fmt.Errorf("`on_error` must be a string, not a %s", onError.Type()))
+	}
+
+	switch maxFailures := table.RawGetString("max_failures").(type) {
+	case *lua.LNilType:
+	case lua.LNumber:
+		if maxFailures < 1 {
+			errs = append(errs, fmt.Errorf("`max_failures` must be at least 1"))
+		}
+		cc.MaxFailures = int(maxFailures)
+	default:
+		errs = append(errs, fmt.Errorf("`max_failures` must be a number, not a %s", maxFailures.Type()))
+	}
+
+	return cc, errs
+}
+
+func loggingConfigFromLua(table *lua.LTable) (LoggingConfig, []error) {
+	lc := LoggingConfig{}
+	errs := []error{}
+
+	switch level := table.RawGetString("level").(type) {
+	case *lua.LNilType:
+	case lua.LString:
+		_, err := logging.ParseLevel(string(level))
+		if err != nil {
+			errs = append(errs, err)
+		}
+		lc.Level = string(level)
+	default:
+		errs = append(errs, fmt.Errorf("`level` must be a string, not a %s", level.Type()))
+	}
+
+	switch format := table.RawGetString("format").(type) {
+	case *lua.LNilType:
+	case lua.LString:
+		if format != "text" && format != "json" {
+			errs = append(errs, fmt.Errorf("`format` must be \"text\" or \"json\", not %q", format))
+		}
+		lc.Format = string(format)
+	default:
+		errs = append(errs, fmt.Errorf("`format` must be a string, not a %s", format.Type()))
+	}
+
+	switch output := table.RawGetString("output").(type) {
+	case *lua.LNilType:
+	case lua.LString:
+		if output != "stderr" && output != "syslog" && output != "journald" {
+			errs = append(errs, fmt.Errorf("`output` must be \"stderr\", \"syslog\" or \"journald\", not %q", output))
+		}
+		lc.Output = string(output)
+	default:
+		errs = append(errs, fmt.Errorf("`output` must be a string, not a %s", output.Type()))
+	}
+
+	return lc, errs
+}
@@ -38,9 +38,9 @@ func (m *dnsModule) dnsLookupFunc(network string) lua.LGFunction {
 
 		switch m.timeout {
 		case 0:
-			ctx = context.Background()
+			ctx = callContext(l)
 		default:
-			ctx, cancelFunc = context.WithTimeout(context.Background(), m.timeout)
+			ctx, cancelFunc = context.WithTimeout(callContext(l), m.timeout)
 		}
 
 		if cancelFunc != nil {
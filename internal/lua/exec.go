@@ -0,0 +1,229 @@
+package lua
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// execCommand is a command passed to exec.run, e.g. {"ip", "route", "show", timeout = 5}
+type execCommand struct {
+	name    string
+	args    []string
+	timeout time.Duration // No timeout if zero
+	env     []string      // Added to failoverd's environment, in "NAME=value" form
+}
+
+type execResult struct {
+	code   int
+	stdout string
+	stderr string
+	err    error // Set if the command could not be started or timed out, in which case code is meaningless
+}
+
+func checkExecCommand(l *lua.LState, n int) execCommand {
+	table := l.CheckTable(n)
+	c := execCommand{}
+
+	for i := 1; i <= table.Len(); i++ {
+		arg, ok := table.RawGetInt(i).(lua.LString)
+		if !ok {
+			l.ArgError(n, fmt.Sprintf("item %d must be a string, not a %s", i, table.RawGetInt(i).Type()))
+			return c
+		}
+
+		if i == 1 {
+			c.name = string(arg)
+		} else {
+			c.args = append(c.args, string(arg))
+		}
+	}
+
+	if c.name == "" {
+		l.ArgError(n, "no command specified")
+		return c
+	}
+
+	switch timeout := table.RawGetString("timeout").(type) {
+	case *lua.LNilType:
+	case lua.LNumber:
+		c.timeout = time.Duration(float64(timeout) * float64(time.Second))
+	default:
+		l.ArgError(n, fmt.Sprintf("`timeout` must be a number, not a %s", timeout.Type()))
+		return c
+	}
+
+	switch env := table.RawGetString("env").(type) {
+	case *lua.LNilType:
+	case *lua.LTable:
+		var err error
+		env.ForEach(func(key lua.LValue, val lua.LValue) {
+			name, ok := key.(lua.LString)
+			if !ok || val.Type() != lua.LTString {
+				err = fmt.Errorf("`env` must map strings to strings")
+				return
+			}
+			c.env = append(c.env, fmt.Sprintf("%s=%s", name, val))
+		})
+		if err != nil {
+			l.ArgError(n, err.Error())
+			return c
+		}
+	default:
+		l.ArgError(n, fmt.Sprintf("`env` must be a table, not a %s", env.Type()))
+		return c
+	}
+
+	return c
+}
+
+// commandWaitDelay limits how long a killed command's output is waited for, in case a process
+// outside its process group still holds its stdout or stderr open
+const commandWaitDelay = 1 * time.Second
+
+// commandContext is like exec.CommandContext, but the command is run in its own process group,
+// which is killed once ctx is done. exec.CommandContext only kills the command itself, and Wait
+// then blocks until any children that inherited its stdout or stderr exit, e.g. the sleep in
+// sh -c "sleep 60; echo done".
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = commandWaitDelay
+
+	return cmd
+}
+
+func (c execCommand) String() string {
+	return strings.Join(append([]string{c.name}, c.args...), " ")
+}
+
+// run runs the command. It is killed if ctx is done, or once its own timeout expires.
+func (c execCommand) run(ctx context.Context) execResult {
+	if c.timeout > 0 {
+		var cancelFunc func()
+		ctx, cancelFunc = context.WithTimeout(ctx, c.timeout)
+		defer cancelFunc()
+	}
+
+	cmd := commandContext(ctx, c.name, c.args...)
+	if c.env != nil {
+		cmd.Env = append(os.Environ(), c.env...)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	res := execResult{
+		stdout: stdout.String(),
+		stderr: stderr.String(),
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded && c.timeout > 0:
+		res.err = fmt.Errorf("%s: timed out after %s", c.name, c.timeout)
+	case ctx.Err() != nil:
+		res.err = fmt.Errorf("%s: %w", c.name, ctx.Err())
+	case errors.As(err, &exitErr):
+		res.code = exitErr.ExitCode()
+	case err != nil:
+		res.err = err
+	}
+
+	return res
+}
+
+// push pushes the return values of exec.run: the exit code (nil if the command could not be
+// started or timed out), stdout, stderr, and an error message if there was one
+func (res execResult) push(l *lua.LState) int {
+	if res.err != nil {
+		l.Push(lua.LNil)
+	} else {
+		l.Push(lua.LNumber(res.code))
+	}
+
+	l.Push(lua.LString(res.stdout))
+	l.Push(lua.LString(res.stderr))
+
+	if res.err != nil {
+		l.Push(lua.LString(res.err.Error()))
+		return 4
+	}
+
+	return 3
+}
+
+func (e *Engine) execLoader(l *lua.LState) int {
+	module := l.SetFuncs(l.NewTable(), map[string]lua.LGFunction{
+		"run":       e.execRun,
+		"run_async": e.execRunAsync,
+	})
+	l.Push(module)
+	return 1
+}
+
+// dryRunExec reports a command that is not run because exec interception is enabled
+func (e *Engine) dryRunExec(fn string, command string) execResult {
+	if e.interceptor != nil {
+		e.interceptor(fn + " " + command)
+	} else {
+		e.logger().Info("dry run: not running command", "function", fn, "command", command)
+	}
+
+	return execResult{}
+}
+
+func (e *Engine) execRun(l *lua.LState) int {
+	c := checkExecCommand(l, 1)
+
+	if e.interceptExec {
+		return e.dryRunExec("exec.run", c.String()).push(l)
+	}
+
+	return c.run(callContext(l)).push(l)
+}
+
+// execRunAsync runs a command in the background, then calls a function with the results of
+// the command on the dispatcher goroutine
+func (e *Engine) execRunAsync(l *lua.LState) int {
+	c := checkExecCommand(l, 1)
+	fn := l.CheckFunction(2)
+
+	go func() {
+		var res execResult
+		if e.interceptExec {
+			res = e.dryRunExec("exec.run_async", c.String())
+		} else {
+			res = c.run(context.Background())
+		}
+
+		err := e.do(func(l *lua.LState) error {
+			err := e.withLimits(l, func() error {
+				l.Push(fn)
+				return l.PCall(res.push(l), 0, nil)
+			})
+
+			e.countOtherCallback("exec.run_async", err, "error calling exec.run_async callback", "command", c.String())
+			return nil
+		})
+
+		if err != nil && err != ErrClosed {
+			e.logger().Error("could not call exec.run_async callback", "command", c.String(), "err", err)
+		}
+	}()
+
+	return 0
+}
@@ -0,0 +1,128 @@
+package lua
+
+import (
+	"os"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// registerFailoverdModule creates the global `failoverd` table, which gives scripts
+// access to the state of the daemon itself.
+func (e *Engine) registerFailoverdModule(l *lua.LState) {
+	module := l.SetFuncs(l.NewTable(), map[string]lua.LGFunction{
+		"dry_run":        e.failoverdDryRun,
+		"setup":          e.failoverdSetup,
+		"event":          e.failoverdEvent,
+		"callback_stats": e.failoverdCallbackStats,
+	})
+	l.SetGlobal("failoverd", module)
+
+	if e.interceptExec {
+		e.interceptOSExecute(l)
+	} else {
+		cancellableOSExecute(l)
+	}
+}
+
+func (e *Engine) failoverdDryRun(l *lua.LState) int {
+	l.Push(lua.LBool(e.dryRun))
+	return 1
+}
+
+// failoverdSetup records the configuration table. The settings in it are read once the script has finished.
+func (e *Engine) failoverdSetup(l *lua.LState) int {
+	table := l.CheckTable(1)
+
+	if e.setup != nil {
+		l.RaiseError("failoverd.setup must only be called once")
+		return 0
+	}
+
+	e.setup = table
+	return 0
+}
+
+// failoverdEvent records an event of the given type, with an optional message,
+// e.g. failoverd.event("route_changed", "default via 192.168.0.2")
+func (e *Engine) failoverdEvent(l *lua.LState) int {
+	typ := l.CheckString(1)
+	message := l.OptString(2, "")
+
+	if e.running == "on_event" {
+		l.RaiseError("failoverd.event cannot be called from on_event")
+		return 0
+	}
+
+	e.recordEvent(typ, "", message)
+	return 0
+}
+
+// failoverdCallbackStats returns a table mapping the names of callbacks to their statistics,
+// e.g. failoverd.callback_stats().on_update.errors
+func (e *Engine) failoverdCallbackStats(l *lua.LState) int {
+	table := l.NewTable()
+
+	for name, cs := range e.CallbackStats() {
+		t := l.NewTable()
+		t.RawSetString("calls", lua.LNumber(cs.Calls))
+		t.RawSetString("errors", lua.LNumber(cs.Errors))
+		t.RawSetString("consecutive_errors", lua.LNumber(cs.ConsecutiveErrors))
+		if cs.LastError != "" {
+			t.RawSetString("last_error", lua.LString(cs.LastError))
+		}
+		t.RawSetString("disabled", lua.LBool(cs.Disabled))
+
+		table.RawSetString(name, t)
+	}
+
+	l.Push(table)
+	return 1
+}
+
+// cancellableOSExecute replaces os.execute with one that kills its command once the callback's
+// timeout expires, which gopher-lua's own os.execute cannot. Like it, the command is run with
+// /bin/sh -c and the function returns 0 if the command succeeded and 1 otherwise.
+func cancellableOSExecute(l *lua.LState) {
+	osModule, ok := l.GetGlobal("os").(*lua.LTable)
+	if !ok || osModule.RawGetString("execute") == lua.LNil {
+		return
+	}
+
+	l.SetField(osModule, "execute", l.NewFunction(func(l *lua.LState) int {
+		// As for exec.run, the shell's children are killed along with it
+		cmd := commandContext(callContext(l), "/bin/sh", "-c", l.CheckString(1))
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		if cmd.Run() != nil {
+			l.Push(lua.LNumber(1))
+			return 1
+		}
+
+		l.Push(lua.LNumber(0))
+		return 1
+	}))
+}
+
+// interceptOSExecute replaces os.execute with a function that logs its command and reports success
+func (e *Engine) interceptOSExecute(l *lua.LState) {
+	osModule, ok := l.GetGlobal("os").(*lua.LTable)
+	if !ok || osModule.RawGetString("execute") == lua.LNil {
+		return
+	}
+
+	l.SetField(osModule, "execute", l.NewFunction(func(l *lua.LState) int {
+		args := make([]string, 0, l.GetTop())
+		for i := 1; i <= l.GetTop(); i++ {
+			args = append(args, l.CheckString(i))
+		}
+
+		e.dryRunExec("os.execute", strings.Join(args, " "))
+
+		// Same as a command that exited successfully
+		l.Push(lua.LNumber(0))
+		return 1
+	}))
+}
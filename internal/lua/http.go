@@ -0,0 +1,297 @@
+package lua
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sector-f/failoverd/internal/ping"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	defaultHTTPTimeout = 30 * time.Second
+	maxHTTPBodySize    = 10 << 20 // Longer response bodies are truncated
+)
+
+// httpRequest is a request described by the options table passed to the `http` module
+type httpRequest struct {
+	method  string
+	url     string
+	headers map[string]string
+	body    []byte
+	timeout time.Duration
+	source  string // Source address or interface name. Chosen by the kernel if empty.
+}
+
+type httpResponse struct {
+	status  int
+	headers http.Header
+	body    []byte
+}
+
+// checkHTTPRequest reads a request from the options table at index n. method and url are
+// used if they are not empty; otherwise they are read from the table.
+func checkHTTPRequest(l *lua.LState, n int, method string, url string) httpRequest {
+	opts, ok := l.Get(n).(*lua.LTable)
+	if !ok {
+		if l.Get(n) != lua.LNil {
+			l.ArgError(n, fmt.Sprintf("options must be a table, not a %s", l.Get(n).Type()))
+		}
+		opts = l.NewTable()
+	}
+
+	r := httpRequest{
+		method:  method,
+		url:     url,
+		headers: make(map[string]string),
+		timeout: defaultHTTPTimeout,
+	}
+
+	optString := func(name string) string {
+		switch v := opts.RawGetString(name).(type) {
+		case *lua.LNilType:
+			return ""
+		case lua.LString:
+			return string(v)
+		default:
+			l.ArgError(n, fmt.Sprintf("`%s` must be a string, not a %s", name, v.Type()))
+			return ""
+		}
+	}
+
+	if r.method == "" {
+		r.method = optString("method")
+		if r.method == "" {
+			r.method = http.MethodGet
+		}
+	}
+
+	if r.url == "" {
+		r.url = optString("url")
+		if r.url == "" {
+			l.ArgError(n, "no url specified")
+		}
+	}
+
+	r.source = optString("source")
+
+	switch headers := opts.RawGetString("headers").(type) {
+	case *lua.LNilType:
+	case *lua.LTable:
+		headers.ForEach(func(key lua.LValue, val lua.LValue) {
+			if key.Type() != lua.LTString || val.Type() != lua.LTString {
+				l.ArgError(n, "`headers` must map strings to strings")
+			}
+			r.headers[key.String()] = val.String()
+		})
+	default:
+		l.ArgError(n, fmt.Sprintf("`headers` must be a table, not a %s", headers.Type()))
+	}
+
+	switch timeout := opts.RawGetString("timeout").(type) {
+	case *lua.LNilType:
+	case lua.LNumber:
+		r.timeout = time.Duration(float64(timeout) * float64(time.Second))
+	default:
+		l.ArgError(n, fmt.Sprintf("`timeout` must be a number, not a %s", timeout.Type()))
+	}
+
+	body := opts.RawGetString("body")
+	jsonBody := opts.RawGetString("json")
+	switch {
+	case body != lua.LNil && jsonBody != lua.LNil:
+		l.ArgError(n, "only one of `body` and `json` may be given")
+	case body != lua.LNil:
+		s, ok := body.(lua.LString)
+		if !ok {
+			l.ArgError(n, fmt.Sprintf("`body` must be a string, not a %s", body.Type()))
+		}
+		r.body = []byte(s)
+	case jsonBody != lua.LNil:
+		v, err := toJSONValue(l, jsonBody)
+		if err != nil {
+			l.ArgError(n, fmt.Sprintf("`json`: %s", err))
+		}
+
+		r.body, err = json.Marshal(v)
+		if err != nil {
+			l.ArgError(n, fmt.Sprintf("`json`: %s", err))
+		}
+
+		if _, ok := r.headers["Content-Type"]; !ok {
+			r.headers["Content-Type"] = "application/json"
+		}
+	}
+
+	return r
+}
+
+// do sends the request. It is abandoned if ctx is done, or once the request's own timeout expires.
+func (r httpRequest) do(ctx context.Context) (httpResponse, error) {
+	ctx, cancelFunc := context.WithTimeout(ctx, r.timeout)
+	defer cancelFunc()
+
+	req, err := http.NewRequestWithContext(ctx, r.method, r.url, bytes.NewReader(r.body))
+	if err != nil {
+		return httpResponse{}, err
+	}
+
+	for name, value := range r.headers {
+		req.Header.Set(name, value)
+	}
+
+	client := http.DefaultClient
+	if r.source != "" {
+		transport, err := sourceTransport(r.source)
+		if err != nil {
+			return httpResponse{}, err
+		}
+		defer transport.CloseIdleConnections()
+
+		client = &http.Client{Transport: transport}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return httpResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPBodySize))
+	if err != nil {
+		return httpResponse{}, err
+	}
+
+	return httpResponse{
+		status:  resp.StatusCode,
+		headers: resp.Header,
+		body:    body,
+	}, nil
+}
+
+// sourceTransport returns a transport whose connections are made from the given source address,
+// or from the address of the given interface, so that requests leave through a specific uplink
+func sourceTransport(source string) (*http.Transport, error) {
+	ip := net.ParseIP(source)
+	if ip == nil {
+		var err error
+		ip, err = ping.InterfaceAddress(source)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dialer := &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: ip},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+
+	return transport, nil
+}
+
+// push pushes the return values of the `http` module's functions: a response table,
+// or nil and an error message
+func (resp httpResponse) push(l *lua.LState, err error) int {
+	if err != nil {
+		l.Push(lua.LNil)
+		l.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	headers := l.NewTable()
+	for name, values := range resp.headers {
+		if len(values) > 0 {
+			headers.RawSetString(name, lua.LString(values[0]))
+		}
+	}
+
+	table := l.NewTable()
+	table.RawSetString("status", lua.LNumber(resp.status))
+	table.RawSetString("headers", headers)
+	table.RawSetString("body", lua.LString(resp.body))
+
+	l.Push(table)
+	return 1
+}
+
+func (e *Engine) httpLoader(l *lua.LState) int {
+	module := l.SetFuncs(l.NewTable(), map[string]lua.LGFunction{
+		"get": func(l *lua.LState) int {
+			return e.httpDo(l, "http.get", checkHTTPRequest(l, 2, http.MethodGet, l.CheckString(1)))
+		},
+		"post": func(l *lua.LState) int {
+			return e.httpDo(l, "http.post", checkHTTPRequest(l, 2, http.MethodPost, l.CheckString(1)))
+		},
+		"request": func(l *lua.LState) int {
+			l.CheckTable(1)
+			return e.httpDo(l, "http.request", checkHTTPRequest(l, 1, "", ""))
+		},
+		"request_async": e.httpRequestAsync,
+	})
+	l.Push(module)
+	return 1
+}
+
+func (e *Engine) httpDo(l *lua.LState, fn string, r httpRequest) int {
+	if e.interceptHTTP {
+		return e.interceptRequest(fn, r).push(l, nil)
+	}
+
+	resp, err := r.do(callContext(l))
+	return resp.push(l, err)
+}
+
+// interceptRequest reports a request that is not sent because http interception is enabled
+func (e *Engine) interceptRequest(fn string, r httpRequest) httpResponse {
+	if e.interceptor != nil {
+		e.interceptor(fmt.Sprintf("%s %s %s", fn, r.method, r.url))
+	} else {
+		e.logger().Info("dry run: not sending request", "function", fn, "method", r.method, "url", r.url)
+	}
+
+	return httpResponse{status: http.StatusOK, headers: make(http.Header)}
+}
+
+// httpRequestAsync sends a request in the background, then calls a function with the response
+// on the dispatcher goroutine
+func (e *Engine) httpRequestAsync(l *lua.LState) int {
+	l.CheckTable(1)
+	r := checkHTTPRequest(l, 1, "", "")
+	fn := l.CheckFunction(2)
+
+	go func() {
+		var (
+			resp    httpResponse
+			respErr error
+		)
+		if e.interceptHTTP {
+			resp = e.interceptRequest("http.request_async", r)
+		} else {
+			resp, respErr = r.do(context.Background())
+		}
+
+		err := e.do(func(l *lua.LState) error {
+			err := e.withLimits(l, func() error {
+				l.Push(fn)
+				return l.PCall(resp.push(l, respErr), 0, nil)
+			})
+
+			e.countOtherCallback("http.request_async", err, "error calling http.request_async callback", "method", r.method, "url", r.url)
+			return nil
+		})
+
+		if err != nil && err != ErrClosed {
+			e.logger().Error("could not call http.request_async callback", "method", r.method, "url", r.url, "err", err)
+		}
+	}()
+
+	return 0
+}
@@ -0,0 +1,212 @@
+package lua
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/sector-f/failoverd/internal/ping"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// maxJSONDepth limits how deeply tables are nested when converting them to JSON,
+	// which also catches tables that contain themselves
+	maxJSONDepth = 64
+
+	// luaJSONArrayTypeName is the metatable that marks tables as JSON arrays, even if they are empty
+	luaJSONArrayTypeName = "json_array"
+)
+
+// jsonNull is the value of the json.null userdata, which represents JSON's null
+// where nil cannot be used, e.g. in arrays
+type jsonNull struct{}
+
+// toJSONValue converts a Lua value into a value that encoding/json can marshal.
+// Tables with the json_array metatable, or whose keys are exactly 1..n, become arrays;
+// other tables become objects. probe_stats and global_probe_stats become objects.
+func toJSONValue(l *lua.LState, lv lua.LValue) (interface{}, error) {
+	return toJSONValueDepth(l, lv, 0)
+}
+
+func toJSONValueDepth(l *lua.LState, lv lua.LValue, depth int) (interface{}, error) {
+	if depth > maxJSONDepth {
+		return nil, fmt.Errorf("tables are nested too deeply (or contain themselves)")
+	}
+
+	switch v := lv.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		if math.IsInf(float64(v), 0) || math.IsNaN(float64(v)) {
+			return nil, fmt.Errorf("%v cannot be represented in JSON", v)
+		}
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		return tableToJSONValue(l, v, depth)
+	case *lua.LUserData:
+		switch value := v.Value.(type) {
+		case jsonNull:
+			return nil, nil
+		case *ping.ProbeStats:
+			return *value, nil
+		case ping.Snapshot:
+			return value, nil
+		}
+		return nil, fmt.Errorf("a %s cannot be represented in JSON", lv.Type())
+	default:
+		return nil, fmt.Errorf("a %s cannot be represented in JSON", lv.Type())
+	}
+}
+
+func tableToJSONValue(l *lua.LState, table *lua.LTable, depth int) (interface{}, error) {
+	n := table.Len()
+	arrayMT := l.GetTypeMetatable(luaJSONArrayTypeName) // nil until the json module is loaded
+	isArray := arrayMT != lua.LNil && l.GetMetatable(table) == arrayMT
+
+	// Count the keys to tell whether the table is an array
+	keys := 0
+	table.ForEach(func(_ lua.LValue, _ lua.LValue) {
+		keys++
+	})
+
+	if isArray || (n > 0 && keys == n) {
+		array := make([]interface{}, 0, n)
+		for i := 1; i <= n; i++ {
+			v, err := toJSONValueDepth(l, table.RawGetInt(i), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, v)
+		}
+
+		return array, nil
+	}
+
+	object := make(map[string]interface{}, keys)
+
+	var err error
+	table.ForEach(func(key lua.LValue, val lua.LValue) {
+		if err != nil {
+			return
+		}
+
+		switch key.(type) {
+		case lua.LString, lua.LNumber:
+		default:
+			err = fmt.Errorf("object keys must be strings or numbers, not a %s", key.Type())
+			return
+		}
+
+		object[key.String()], err = toJSONValueDepth(l, val, depth+1)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return object, nil
+}
+
+// fromJSONValue converts a value unmarshaled by encoding/json into a Lua value.
+// Arrays are given the json_array metatable, so that they are encoded as arrays again.
+func fromJSONValue(l *lua.LState, v interface{}, null lua.LValue) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return null
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		table := l.CreateTable(len(v), 0)
+		for _, item := range v {
+			table.Append(fromJSONValue(l, item, null))
+		}
+		l.SetMetatable(table, l.GetTypeMetatable(luaJSONArrayTypeName))
+		return table
+	case map[string]interface{}:
+		table := l.CreateTable(0, len(v))
+		for key, item := range v {
+			table.RawSetString(key, fromJSONValue(l, item, null))
+		}
+		return table
+	default:
+		return lua.LNil
+	}
+}
+
+// jsonModule is the `json` module. Each Lua state has its own null value.
+type jsonModule struct {
+	null *lua.LUserData
+}
+
+func (m *jsonModule) loader(l *lua.LState) int {
+	l.NewTypeMetatable(luaJSONArrayTypeName)
+	m.null = l.NewUserData()
+	m.null.Value = jsonNull{}
+
+	module := l.SetFuncs(l.NewTable(), map[string]lua.LGFunction{
+		"encode": m.jsonEncode,
+		"decode": m.jsonDecode,
+		"array":  m.jsonArray,
+	})
+	l.SetField(module, "null", m.null)
+
+	l.Push(module)
+	return 1
+}
+
+func (m *jsonModule) jsonEncode(l *lua.LState) int {
+	v, err := toJSONValue(l, l.CheckAny(1))
+	if err != nil {
+		l.ArgError(1, err.Error())
+		return 0
+	}
+
+	indent := l.OptBool(2, false)
+
+	var b []byte
+	if indent {
+		b, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		b, err = json.Marshal(v)
+	}
+	if err != nil {
+		l.ArgError(1, err.Error())
+		return 0
+	}
+
+	l.Push(lua.LString(b))
+	return 1
+}
+
+func (m *jsonModule) jsonDecode(l *lua.LState) int {
+	s := l.CheckString(1)
+
+	var v interface{}
+	err := json.Unmarshal([]byte(s), &v)
+	if err != nil {
+		l.Push(lua.LNil)
+		l.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	l.Push(fromJSONValue(l, v, m.null))
+	return 1
+}
+
+// jsonArray marks a table as an array, so that it is encoded as one even if it is empty
+func (m *jsonModule) jsonArray(l *lua.LState) int {
+	table := l.OptTable(1, l.NewTable())
+	l.SetMetatable(table, l.GetTypeMetatable(luaJSONArrayTypeName))
+
+	l.Push(table)
+	return 1
+}
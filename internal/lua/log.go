@@ -0,0 +1,82 @@
+package lua
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func (e *Engine) logLoader(l *lua.LState) int {
+	module := l.SetFuncs(l.NewTable(), map[string]lua.LGFunction{
+		"debug": e.logFunc(slog.LevelDebug),
+		"info":  e.logFunc(slog.LevelInfo),
+		"warn":  e.logFunc(slog.LevelWarn),
+		"error": e.logFunc(slog.LevelError),
+	})
+	l.Push(module)
+	return 1
+}
+
+// logFunc returns a function that logs a message at the given level, with the fields in
+// its optional second argument, e.g. log.info("switched uplink", {dst = "192.168.0.1"})
+func (e *Engine) logFunc(level slog.Level) lua.LGFunction {
+	return func(l *lua.LState) int {
+		msg := l.CheckString(1)
+		fields := l.OptTable(2, nil)
+
+		logger := e.logger()
+		if !logger.Enabled(context.Background(), level) {
+			return 0
+		}
+
+		attrs, err := logAttrs(l, fields)
+		if err != nil {
+			l.ArgError(2, err.Error())
+			return 0
+		}
+
+		logger.LogAttrs(context.Background(), level, msg, attrs...)
+		return 0
+	}
+}
+
+// logAttrs converts a table of fields to attributes, sorted by name.
+// Tables and userdata are converted as by json.encode.
+func logAttrs(l *lua.LState, fields *lua.LTable) ([]slog.Attr, error) {
+	if fields == nil {
+		return nil, nil
+	}
+
+	attrs := []slog.Attr{}
+
+	var err error
+	fields.ForEach(func(key lua.LValue, val lua.LValue) {
+		if err != nil {
+			return
+		}
+
+		name, ok := key.(lua.LString)
+		if !ok {
+			err = fmt.Errorf("field names must be strings, not a %s", key.Type())
+			return
+		}
+
+		var v interface{}
+		v, err = toJSONValue(l, val)
+		if err != nil {
+			err = fmt.Errorf("field `%s`: %w", name, err)
+			return
+		}
+
+		attrs = append(attrs, slog.Any(string(name), v))
+	})
+
+	sort.Slice(attrs, func(i, j int) bool {
+		return attrs[i].Key < attrs[j].Key
+	})
+
+	return attrs, err
+}
@@ -1,126 +1,383 @@
 package lua
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/sector-f/failoverd/internal/clock"
+	"github.com/sector-f/failoverd/internal/events"
 	"github.com/sector-f/failoverd/internal/ping"
 	lua "github.com/yuin/gopher-lua"
 )
 
+// ErrClosed is returned when a callback is made after the Engine has been closed.
+var ErrClosed = errors.New("lua engine is closed")
+
+// Engine owns the Lua state created from the configuration script.
+//
+// gopher-lua states are not safe for concurrent use, so after New returns, the state is
+// only ever touched by a single dispatcher goroutine. Callbacks are queued to it and
+// the calling goroutine waits for them to finish.
 type Engine struct {
 	Config Config
 
 	state  *lua.LState
-	pinger *ping.Pinger
+	pinger ProbeController
+
+	calls     chan call
+	done      chan struct{}
+	closeOnce sync.Once
+
+	checkProbes   bool
+	dryRun        bool
+	interceptExec bool
+	interceptHTTP bool
+	interceptor   func(action string) // Called with intercepted commands and requests; they are logged if nil
+
+	sandbox *Sandbox      // Nil unless the script is sandboxed
+	timeout time.Duration // Limit on loading the script and on each callback; none if zero
+
+	setup *lua.LTable // The table passed to failoverd.setup, if it was called
+
+	loading   bool    // Whether the script is being loaded by New
+	probeErrs []error // Problems with the options passed to probe.new while loading
+
+	clock  clock.Clock
+	timers *timers
+
+	values map[string]interface{} // Saved by the `state` module, in the form decoded by encoding/json
+
+	events  atomic.Pointer[EventRecorder] // Nil until SetEventRecorder is called
+	running string                        // The name of the on_* callback that is running, if any
+
+	callbackStats map[string]*CallbackStats
+	callbackMu    sync.Mutex
+	fatal         chan error
+
+	log atomic.Pointer[slog.Logger] // Read by goroutines other than the dispatcher, so it is atomic
+}
+
+// ProbeController starts and stops probes on behalf of scripts. It is implemented by *ping.Pinger.
+type ProbeController interface {
+	StartProbe(probe ping.Probe) error
+	StopProbe(dst string) error
+}
+
+// EventRecorder records events, such as those recorded by scripts with failoverd.event
+// and callback errors. It must be safe for concurrent use, and must not call back into the Engine.
+type EventRecorder interface {
+	RecordEvent(typ string, dst string, message string)
+}
+
+// A call is a function queued to run on the dispatcher goroutine.
+type call struct {
+	fn     func(l *lua.LState) error
+	result chan error
+}
+
+// An Option configures an Engine before the configuration script is run.
+type Option func(e *Engine)
+
+// WithDryRun makes the Engine report that it is in dry-run mode via failoverd.dry_run().
+// If intercept is true, os.execute and the `exec` module log their commands and report success
+// instead of running them, and the `http` module logs its requests and reports a 200 response
+// with an empty body instead of sending them.
+func WithDryRun(intercept bool) Option {
+	return func(e *Engine) {
+		e.dryRun = true
+		if intercept {
+			e.interceptExec = true
+			e.interceptHTTP = true
+		}
+	}
 }
 
-func New(configFile string) (*Engine, error) {
-	lstate := lua.NewState()
+// WithInterceptor makes os.execute, the `exec` module and the `http` module pass a description
+// of each command or request to fn instead of carrying it out, e.g. "exec.run ip route show".
+// Commands report success, and requests a 200 response with an empty body. fn is called on
+// the dispatcher goroutine, or for the async functions, on the goroutine they start.
+func WithInterceptor(fn func(action string)) Option {
+	return func(e *Engine) {
+		e.interceptExec = true
+		e.interceptHTTP = true
+		e.interceptor = fn
+	}
+}
+
+// WithProbeChecks makes New validate every probe with Config.CheckProbes, including whether
+// the interfaces given as sources exist, and report any problems along with the other ConfigErrors.
+func WithProbeChecks() Option {
+	return func(e *Engine) {
+		e.checkProbes = true
+	}
+}
+
+// WithClock sets the clock used by the `timer` module. The default is clock.Real().
+func WithClock(c clock.Clock) Option {
+	return func(e *Engine) {
+		e.clock = c
+	}
+}
+
+// WithLogger sets the logger used by the Engine and the `log` module. The default is slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(e *Engine) {
+		e.log.Store(logger)
+	}
+}
+
+func New(configFile string, options ...Option) (*Engine, error) {
+	e := &Engine{
+		calls: make(chan call, 64),
+		done:  make(chan struct{}),
+
+		clock: clock.Real(),
+
+		values: make(map[string]interface{}),
+
+		callbackStats: make(map[string]*CallbackStats),
+		fatal:         make(chan error, 1),
+	}
+	e.log.Store(slog.Default())
+
+	for _, option := range options {
+		option(e)
+	}
+
+	modules := map[string]lua.LGFunction{
+		"dns":   (&dnsModule{}).loader,
+		"timer": e.timerLoader,
+		"exec":  e.execLoader,
+		"http":  e.httpLoader,
+		"json":  (&jsonModule{}).loader,
+		"log":   e.logLoader,
+		"state": e.stateLoader,
+	}
+
+	var lstate *lua.LState
+	if e.sandbox != nil {
+		for _, name := range e.sandbox.Modules {
+			if _, ok := modules[name]; !ok {
+				return nil, fmt.Errorf("sandbox: unknown module %q", name)
+			}
+		}
+
+		lstate = newSandboxedState(*e.sandbox)
+	} else {
+		lstate = lua.NewState()
+	}
+	e.state = lstate
+
+	e.timers = newTimers(e.clock)
+
 	registerTypes(lstate)
-	lstate.PreloadModule("dns", (&dnsModule{}).loader)
+	registerCoroutines(lstate)
+	e.registerProbePingerCommands(lstate)
+	e.registerFailoverdModule(lstate)
+	for name, loader := range modules {
+		if e.sandbox.allowsModule(name) {
+			lstate.PreloadModule(name, loader)
+		}
+	}
 
-	err := lstate.DoFile(configFile)
+	e.loading = true
+	err := e.withLimits(lstate, func() error {
+		return lstate.DoFile(configFile)
+	})
+	e.loading = false
 	if err != nil {
+		lstate.Close()
 		return nil, err
 	}
 
-	config, err := configFromLua(lstate)
+	// DoFile leaves the script's return values on the stack
+	src, err := newConfigSource(lstate, configFile, e.setup, lstate.Get(1))
+	lstate.SetTop(0)
 	if err != nil {
+		lstate.Close()
 		return nil, err
 	}
 
-	e := &Engine{
-		Config: config,
-		state:  lstate,
+	config, err := configFromLua(src)
+
+	// Problems with probe options and with the probes themselves are reported along with the rest
+	errs := ConfigErrors(e.probeErrs)
+	switch configErrs := err.(type) {
+	case nil:
+	case ConfigErrors:
+		errs = append(errs, configErrs...)
+	default:
+		errs = append(errs, err)
+	}
+	if e.checkProbes {
+		errs = append(errs, config.CheckProbes()...)
+	}
+	if len(errs) > 0 {
+		lstate.Close()
+		return nil, errs
 	}
+	e.Config = config
 
-	e.registerProbePingerCommands(lstate)
+	// A sandbox's timeout cannot be extended by the script it restricts
+	if config.Callbacks.Timeout > 0 && (e.timeout == 0 || config.Callbacks.Timeout < e.timeout) {
+		e.timeout = config.Callbacks.Timeout
+	}
+
+	go e.dispatch()
 
 	return e, nil
 }
 
-func (e *Engine) SetPinger(p *ping.Pinger) {
-	e.pinger = p
+// dispatch runs queued calls and timer callbacks one at a time until the Engine is closed.
+// Timers that are due are run before each call, so that callbacks always see the effects
+// of timers that should already have fired, even under a fake clock.
+func (e *Engine) dispatch() {
+	for {
+		e.timers.reschedule()
+
+		select {
+		case c := <-e.calls:
+			e.runTimers(e.state)
+			c.result <- c.fn(e.state)
+		case <-e.timers.wakeupC():
+			e.runTimers(e.state)
+		case <-e.done:
+			e.timers.stop()
+			e.state.Close()
+			return
+		}
+	}
+}
+
+// do queues fn to run on the dispatcher goroutine and waits for it to return.
+func (e *Engine) do(fn func(l *lua.LState) error) error {
+	c := call{
+		fn:     fn,
+		result: make(chan error, 1),
+	}
+
+	select {
+	case e.calls <- c:
+	case <-e.done:
+		return ErrClosed
+	}
+
+	select {
+	case err := <-c.result:
+		return err
+	case <-e.done:
+		return ErrClosed
+	}
+}
+
+// SetLogger replaces the logger, e.g. once the logging settings in the configuration are known.
+func (e *Engine) SetLogger(logger *slog.Logger) {
+	e.log.Store(logger)
 }
 
-func (e *Engine) OnRecv(gps map[string]ping.ProbeStats, ps ping.ProbeStats) error {
-	if e.Config.onRecvFunc.Type() != lua.LTNil {
+func (e *Engine) logger() *slog.Logger {
+	return e.log.Load()
+}
+
+func (e *Engine) SetPinger(p ProbeController) {
+	e.do(func(_ *lua.LState) error {
+		e.pinger = p
+		return nil
+	})
+}
+
+// SetEventRecorder sets where events are recorded. Until it is called, events are discarded.
+func (e *Engine) SetEventRecorder(r EventRecorder) {
+	e.events.Store(&r)
+}
+
+func (e *Engine) recordEvent(typ string, dst string, message string) {
+	if r := e.events.Load(); r != nil {
+		(*r).RecordEvent(typ, dst, message)
+	}
+}
+
+// countOtherCallback counts a call to a callback that the script passed to the Engine, such as
+// a timer, rather than one of the on_* functions. Errors are logged and recorded as events.
+func (e *Engine) countOtherCallback(name string, err error, msg string, attrs ...interface{}) {
+	e.countCall(name, err)
+	if err == nil {
+		return
+	}
+
+	e.logger().Error(msg, append(attrs, "err", err)...)
+	e.recordEvent(events.CallbackError, "", fmt.Sprintf("%s: %s", msg, err))
+}
+
+func (e *Engine) OnRecv(gps ping.Snapshot, ps ping.ProbeStats) error {
+	return e.callback("on_recv", e.Config.onRecvFunc, func(l *lua.LState) []lua.LValue {
 		globalProbeStatsUD := &lua.LUserData{
 			Value:     gps,
-			Metatable: e.state.GetTypeMetatable(luaGlobalProbeStatsTypeName),
+			Metatable: l.GetTypeMetatable(luaGlobalProbeStatsTypeName),
 		}
 
 		probeStatsUD := &lua.LUserData{
 			Value:     &ps,
-			Metatable: e.state.GetTypeMetatable(luaProbeStatsTypeName),
-		}
-
-		err := e.state.CallByParam(
-			lua.P{
-				Fn:      e.Config.onRecvFunc,
-				NRet:    0,
-				Protect: true,
-			},
-			globalProbeStatsUD,
-			probeStatsUD,
-		)
-
-		if err != nil {
-			return fmt.Errorf("error calling on_recv function: %w\n", err)
+			Metatable: l.GetTypeMetatable(luaProbeStatsTypeName),
 		}
-	}
 
-	return nil
+		return []lua.LValue{globalProbeStatsUD, probeStatsUD}
+	})
 }
 
-func (e *Engine) OnUpdate(gps map[string]ping.ProbeStats) error {
-	if e.Config.onUpdateFunc.Type() != lua.LTNil {
+func (e *Engine) OnUpdate(gps ping.Snapshot) error {
+	return e.callback("on_update", e.Config.onUpdateFunc, func(l *lua.LState) []lua.LValue {
 		ud := &lua.LUserData{
 			Value:     gps,
-			Metatable: e.state.GetTypeMetatable(luaGlobalProbeStatsTypeName),
+			Metatable: l.GetTypeMetatable(luaGlobalProbeStatsTypeName),
 		}
 
-		err := e.state.CallByParam(
-			lua.P{
-				Fn:      e.Config.onUpdateFunc,
-				NRet:    0,
-				Protect: true,
-			},
-			ud,
-		)
-
-		if err != nil {
-			return fmt.Errorf("error calling on_update function: %w\n", err)
-		}
-	}
-
-	return nil
+		return []lua.LValue{ud}
+	})
 }
 
-func (e *Engine) OnQuit(gps map[string]ping.ProbeStats) error {
-	if e.Config.onQuitFunc.Type() != lua.LTNil {
+func (e *Engine) OnQuit(gps ping.Snapshot) error {
+	return e.callback("on_quit", e.Config.onQuitFunc, func(l *lua.LState) []lua.LValue {
 		ud := &lua.LUserData{
 			Value:     gps,
-			Metatable: e.state.GetTypeMetatable(luaGlobalProbeStatsTypeName),
+			Metatable: l.GetTypeMetatable(luaGlobalProbeStatsTypeName),
 		}
 
-		err := e.state.CallByParam(
-			lua.P{
-				Fn:      e.Config.onQuitFunc,
-				NRet:    0,
-				Protect: true,
-			},
-			ud,
-		)
-
-		if err != nil {
-			return fmt.Errorf("error calling on_quit function: %w\n", err)
+		return []lua.LValue{ud}
+	})
+}
+
+// OnEvent calls on_event with an event. Scripts cannot record events while on_event is running,
+// since every event they recorded would lead to another call.
+func (e *Engine) OnEvent(ev events.Event) error {
+	return e.callback("on_event", e.Config.onEventFunc, func(l *lua.LState) []lua.LValue {
+		table := l.NewTable()
+		table.RawSetString("id", lua.LNumber(ev.ID))
+		table.RawSetString("time", timeToLua(ev.Time))
+		table.RawSetString("type", lua.LString(ev.Type))
+		if ev.Dst != "" {
+			table.RawSetString("dst", lua.LString(ev.Dst))
 		}
-	}
+		if ev.Message != "" {
+			table.RawSetString("message", lua.LString(ev.Message))
+		}
+		table.RawSetString("stats", &lua.LUserData{
+			Value:     ev.Stats,
+			Metatable: l.GetTypeMetatable(luaGlobalProbeStatsTypeName),
+		})
 
-	return nil
+		return []lua.LValue{table}
+	})
 }
 
+// Close stops the dispatcher goroutine, which then closes the Lua state.
+// Callbacks made after Close return ErrClosed.
 func (e *Engine) Close() {
-	e.state.Close()
+	e.closeOnce.Do(func() {
+		close(e.done)
+	})
 }
@@ -0,0 +1,1442 @@
+package lua
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sector-f/failoverd/internal/clock"
+	"github.com/sector-f/failoverd/internal/events"
+	"github.com/sector-f/failoverd/internal/ping"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func newTestEngine(t *testing.T, script string, options ...Option) *Engine {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.lua")
+	err := os.WriteFile(path, []byte(script), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := New(path, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+
+	return e
+}
+
+// checkResult compares the string values of the fields of the global `result` table to expected
+func checkResult(t *testing.T, e *Engine, expected map[string]string) {
+	t.Helper()
+
+	e.do(func(l *lua.LState) error {
+		result, ok := l.GetGlobal("result").(*lua.LTable)
+		if !ok {
+			t.Errorf("`result` is not a table")
+			return nil
+		}
+
+		for key, value := range expected {
+			actual := result.RawGetString(key).String()
+			if actual != value {
+				t.Errorf("%s: expected %s, got %s", key, value, actual)
+			}
+		}
+		return nil
+	})
+}
+
+const baseConfig = `
+ping_frequency = 1
+update_frequency = 1
+privileged = false
+num_seconds = 10
+probes = {}
+`
+
+func TestConcurrentCallbacks(t *testing.T) {
+	e := newTestEngine(t, baseConfig+`
+count = 0
+
+function on_recv(gps, ps)
+	count = count + 1
+end
+
+function on_update(gps)
+	count = count + 1
+end
+`)
+
+	const n = 100
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			ps := ping.ProbeStats{Dst: "192.168.0.1"}
+			err := e.OnRecv(ping.Snapshot{}, ps)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			err := e.OnUpdate(ping.Snapshot{})
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	wg.Wait()
+
+	var count float64
+	e.do(func(l *lua.LState) error {
+		count = float64(l.GetGlobal("count").(lua.LNumber))
+		return nil
+	})
+
+	if count != 2*n {
+		t.Fatalf("Expected %d callbacks, got %v", 2*n, count)
+	}
+}
+
+func TestCallAfterClose(t *testing.T) {
+	e := newTestEngine(t, baseConfig+`
+function on_update(gps)
+end
+`)
+
+	e.Close()
+
+	err := e.OnUpdate(ping.Snapshot{})
+	if err != ErrClosed {
+		t.Fatalf("Expected ErrClosed, got %v", err)
+	}
+}
+
+// Starting and stopping probes from on_recv must not deadlock on the dispatcher or the Pinger's lock,
+// since on_recv is called from Pinger.Run
+func TestStartStopProbeInOnRecv(t *testing.T) {
+	e := newTestEngine(t, baseConfig+`
+probes = {probe.new("192.168.0.1")}
+
+function on_recv(gps, ps)
+	if ps:dst() == "192.168.0.1" and not started then
+		started = true
+		probe.start(probe.new("192.168.0.2"))
+	elseif ps:dst() == "192.168.0.2" and not stopped then
+		stopped = true
+		probe.stop("192.168.0.1")
+	end
+end
+`)
+
+	clk := clock.NewFake(time.Unix(1000, 0))
+	prober := ping.NewFakeProber()
+	prober.Script("192.168.0.1", ping.Reply(10*time.Millisecond))
+	prober.Script("192.168.0.2", ping.Reply(10*time.Millisecond))
+
+	p, err := ping.NewPinger(e.Config.Probes, ping.WithClock(clk), ping.WithProber(prober))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.SetPinger(p)
+
+	p.OnRecv = func(ps ping.ProbeStats) {
+		err := e.OnRecv(p.Stats(), ps)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	go p.Run()
+	t.Cleanup(p.Stop)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var stopped bool
+		e.do(func(l *lua.LState) error {
+			stopped = lua.LVAsBool(l.GetGlobal("stopped"))
+			return nil
+		})
+
+		if stopped {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for on_recv to start and stop probes")
+		}
+
+		clk.Advance(1 * time.Second)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := p.Stats()
+	if _, ok := stats.Get("192.168.0.1"); ok {
+		t.Errorf("Expected 192.168.0.1 to be stopped")
+	}
+	if _, ok := stats.Get("192.168.0.2"); !ok {
+		t.Errorf("Expected 192.168.0.2 to be running")
+	}
+}
+
+func TestGlobalProbeStatsQueries(t *testing.T) {
+	e := newTestEngine(t, baseConfig+`
+function on_update(gps)
+	local dsts = {}
+	for dst, ps in gps:pairs() do
+		table.insert(dsts, dst)
+	end
+	result = {
+		len = #gps,
+		pairs = table.concat(dsts, ","),
+		all = #gps:all(),
+		by_rtt = gps:sorted_by("rtt")[1]:dst(),
+		by_loss = gps:sorted_by("loss")[1]:dst(),
+		healthy = #gps:healthy(),
+		filtered = #gps:filter(function(ps) return ps:priority() > 0 end),
+		best = gps:best():dst(),
+		best_rtt = gps:best(function(ps) return ps:rtt() end):dst(),
+	}
+end
+`)
+
+	gps := ping.NewSnapshot(time.Now(), map[string]ping.ProbeStats{
+		"192.168.0.1": {Dst: "192.168.0.1", Priority: 2, Loss: 0, RTT: 30 * time.Millisecond, HasRTT: true},
+		"192.168.0.2": {Dst: "192.168.0.2", Priority: 1, Loss: 0, RTT: 20 * time.Millisecond, HasRTT: true},
+		"192.168.0.3": {Dst: "192.168.0.3", Priority: 0, Loss: 100},
+	})
+
+	err := e.OnUpdate(gps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"len":      "3",
+		"pairs":    "192.168.0.1,192.168.0.2,192.168.0.3",
+		"all":      "3",
+		"by_rtt":   "192.168.0.2",
+		"by_loss":  "192.168.0.2", // Tied with 192.168.0.1, but has a lower priority value
+		"healthy":  "2",
+		"filtered": "2",
+		"best":     "192.168.0.2",
+		"best_rtt": "192.168.0.2",
+	}
+
+	checkResult(t, e, expected)
+}
+
+func TestNamedWindows(t *testing.T) {
+	e := newTestEngine(t, baseConfig+`
+windows = {short = 10, long = 300}
+
+function on_recv(gps, ps)
+	result = {
+		loss = ps:loss(),
+		short = ps:loss("short"),
+		long = ps:loss("long"),
+		long_rtt = ps:rtt("long"),
+		windows = table.concat(ps:windows(), ","),
+		missing = pcall(ps.loss, ps, "missing"),
+	}
+end
+`)
+
+	if e.Config.Windows["short"] != 10 || e.Config.Windows["long"] != 300 {
+		t.Fatalf("Unexpected windows: %v", e.Config.Windows)
+	}
+
+	ps := ping.ProbeStats{
+		Dst:  "192.168.0.1",
+		Loss: 50,
+		Windows: map[string]ping.WindowStats{
+			"short": {Loss: 50},
+			"long":  {Loss: 5, RTT: 20 * time.Millisecond, HasRTT: true},
+		},
+	}
+
+	err := e.OnRecv(ping.Snapshot{}, ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"loss":     "50",
+		"short":    "50",
+		"long":     "5",
+		"long_rtt": "20",
+		"windows":  "long,short",
+		"missing":  "false",
+	}
+
+	checkResult(t, e, expected)
+}
+
+func TestFailoverScriptWithFakeProber(t *testing.T) {
+	e := newTestEngine(t, `
+ping_frequency = 1
+update_frequency = 1
+privileged = false
+num_seconds = 5
+probes = {
+	probe.new("192.168.0.1", {priority = 1}),
+	probe.new("192.168.0.2", {priority = 2}),
+}
+
+function on_update(gps)
+	local best = gps:best()
+	if best ~= nil then
+		active = best:dst()
+	end
+end
+`)
+
+	clk := clock.NewFake(time.Unix(1000, 0))
+	prober := ping.NewFakeProber()
+
+	// The primary goes down after three pings; the secondary is always up
+	prober.Script("192.168.0.1", ping.Reply(10*time.Millisecond), ping.Reply(10*time.Millisecond), ping.Reply(10*time.Millisecond), ping.Lost())
+	prober.Script("192.168.0.2", ping.Reply(50*time.Millisecond))
+
+	p, err := ping.NewPinger(
+		e.Config.Probes,
+		ping.WithNumSeconds(e.Config.NumSeconds),
+		ping.WithClock(clk),
+		ping.WithProber(prober),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.SetPinger(p)
+
+	recv := make(chan struct{}, 100)
+	p.OnRecv = func(ps ping.ProbeStats) {
+		recv <- struct{}{}
+	}
+
+	go p.Run()
+	t.Cleanup(p.Stop)
+
+	expected := []string{"192.168.0.1", "192.168.0.1", "192.168.0.1", "192.168.0.2", "192.168.0.2"}
+	for i, dst := range expected {
+		for j := 0; j < 2; j++ {
+			select {
+			case <-recv:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for probe results")
+			}
+		}
+
+		err := e.OnUpdate(p.Stats())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checkGlobal(t, e, "active", dst, i)
+
+		clk.Advance(1 * time.Second)
+	}
+}
+
+func checkGlobal(t *testing.T, e *Engine, name string, expected string, round int) {
+	t.Helper()
+
+	var actual string
+	e.do(func(l *lua.LState) error {
+		actual = l.GetGlobal(name).String()
+		return nil
+	})
+
+	if actual != expected {
+		t.Fatalf("Round %d: expected `%s` to be %s, got %s", round, name, expected, actual)
+	}
+}
+
+// waitForGlobal waits for a global to be set to expected by an asynchronous callback
+func waitForGlobal(t *testing.T, e *Engine, name string, expected string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var actual string
+		e.do(func(l *lua.LState) error {
+			actual = l.GetGlobal(name).String()
+			return nil
+		})
+
+		if actual == expected {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected `%s` to be %s, got %s", name, expected, actual)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	script := baseConfig + `
+result = {}
+result.dry_run = failoverd.dry_run()
+result.executed = os.execute("false") ~= 0
+`
+
+	e := newTestEngine(t, script)
+	checkResult(t, e, map[string]string{
+		"dry_run":  "false",
+		"executed": "true",
+	})
+
+	e = newTestEngine(t, script, WithDryRun(false))
+	checkResult(t, e, map[string]string{
+		"dry_run":  "true",
+		"executed": "true",
+	})
+
+	e = newTestEngine(t, script, WithDryRun(true))
+	checkResult(t, e, map[string]string{
+		"dry_run":  "true",
+		"executed": "false",
+	})
+}
+
+func TestCheckProbes(t *testing.T) {
+	e := newTestEngine(t, baseConfig+`
+probes = {
+	probe.new("192.168.0.1"),
+	probe.new("not an address"),
+	probe.new("192.168.0.2", "failoverd-test0"),
+}
+`)
+
+	errs := e.Config.CheckProbes()
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %v", errs)
+	}
+
+	for i, position := range []string{"config.lua:10: probe not an address:", "config.lua:11: probe 192.168.0.2:"} {
+		if !strings.Contains(errs[i].Error(), position) {
+			t.Errorf("Expected error %d to contain %q, got %q", i, position, errs[i])
+		}
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.lua")
+	err := os.WriteFile(path, []byte(`ping_frequency = "1"
+update_frequency = 1
+privileged = false
+num_seconds = 10
+probes = {
+	probe.new("192.168.0.1"),
+	"192.168.0.2",
+	probe.new("192.168.0.3"),
+}
+on_recv = 3
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New(path)
+
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected ConfigErrors, got %v", err)
+	}
+
+	expected := []string{
+		path + ":1: `ping_frequency` must be a number, not a string",
+		path + ":7: `probes[2]` must be a probe, not a string",
+		path + ":10: `on_recv` must be a function, not a number",
+	}
+
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, got %v", len(expected), errs)
+	}
+
+	for i := range expected {
+		if errs[i].Error() != expected[i] {
+			t.Errorf("Expected %q, got %q", expected[i], errs[i])
+		}
+	}
+}
+
+func TestProbeOptionErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.lua")
+	err := os.WriteFile(path, []byte(baseConfig+`
+p = probe.new("192.168.0.1", { prio = 1, priority = "high" })
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New(path)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	for _, msg := range []string{"`priority` must be a number, not a string", "unknown option `prio`"} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("Expected error to contain %q, got %q", msg, err)
+		}
+	}
+}
+
+// Problems with probe options and with the probes themselves are reported along with
+// those with the other settings, rather than stopping at the first one
+func TestProbeErrorsWithConfigErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.lua")
+	err := os.WriteFile(path, []byte(`ping_frequency = "fast"
+update_frequency = 1
+privileged = false
+num_seconds = 10
+probes = {
+	probe.new("192.168.0.1", {priority = "high"}),
+	probe.new("192.168.0.2", {prio = 1}),
+	probe.new("not an address"),
+}
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New(path, WithProbeChecks())
+
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected ConfigErrors, got %v", err)
+	}
+
+	expected := []string{
+		path + ":6: probe 192.168.0.1: `priority` must be a number, not a string",
+		path + ":7: probe 192.168.0.2: unknown option `prio`",
+		path + ":1: `ping_frequency` must be a number, not a string",
+		path + ":8: probe not an address:",
+	}
+
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, got %v", len(expected), errs)
+	}
+
+	for i := range expected {
+		if !strings.HasPrefix(errs[i].Error(), expected[i]) {
+			t.Errorf("Expected %q, got %q", expected[i], errs[i])
+		}
+	}
+}
+
+func TestConfigTable(t *testing.T) {
+	settings := `{
+	ping_frequency = 2,
+	update_frequency = 5,
+	privileged = true,
+	num_seconds = 30,
+	probes = {
+		probe.new("192.168.0.1"),
+		probe.new("192.168.0.2"),
+	},
+	on_update = function(gps)
+		updates = updates + 1
+	end,
+}`
+
+	scripts := map[string]string{
+		"setup":    "updates = 0\nfailoverd.setup " + settings,
+		"returned": "updates = 0\nreturn " + settings,
+	}
+
+	for name, script := range scripts {
+		t.Run(name, func(t *testing.T) {
+			e := newTestEngine(t, script)
+
+			c := e.Config
+			if c.PingFrequency != 2*time.Second || c.UpdateFrequency != 5*time.Second || !c.Privileged || c.NumSeconds != 30 {
+				t.Errorf("Unexpected settings: %+v", c)
+			}
+
+			if len(c.Probes) != 2 || c.Probes[1].Dst != "192.168.0.2" {
+				t.Errorf("Unexpected probes: %+v", c.Probes)
+			}
+
+			err := e.OnUpdate(ping.Snapshot{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGlobal(t, e, "updates", "1", 1)
+		})
+	}
+}
+
+func TestConfigTableErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.lua")
+	err := os.WriteFile(path, []byte(`failoverd.setup {
+	ping_frequency = 1,
+	update_frequency = 1,
+	privileged = "no",
+	num_seconds = 10,
+	probes = {},
+}
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New(path)
+
+	expected := path + ":4: `privileged` must be a bool, not a string"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Expected %q, got %v", expected, err)
+	}
+}
+
+func TestConfigTableGroups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.lua")
+	err := os.WriteFile(path, []byte(`return {
+	ping_frequency = 1,
+	update_frequency = 1,
+	privileged = false,
+	num_seconds = 10,
+	probes = {},
+	groups = {uplinks = {"192.168.0.1", "192.168.0.2"}},
+}
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New(path)
+
+	expected := path + ":7: `groups` is not supported; failoverd has no probe groups"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Expected %q, got %v", expected, err)
+	}
+}
+
+func TestTimers(t *testing.T) {
+	clk := clock.NewFake(time.Date(2022, 6, 14, 3, 10, 0, 0, time.UTC))
+	e := newTestEngine(t, baseConfig+`
+local timer = require("timer")
+
+fired = 0
+ticks = 0
+
+timer.after(30, function()
+	fired = fired + 1
+end)
+
+ticker = timer.every(10, function()
+	ticks = ticks + 1
+end)
+
+cancelled = timer.cancel(timer.after(5, function()
+	fired = fired + 100
+end))
+`, WithClock(clk))
+
+	checkGlobal(t, e, "cancelled", "true", 0)
+
+	expected := []struct {
+		fired string
+		ticks string
+	}{
+		{"0", "1"}, // 10s
+		{"0", "2"}, // 20s
+		{"1", "3"}, // 30s
+		{"1", "4"}, // 40s
+	}
+
+	for i, exp := range expected {
+		clk.Advance(10 * time.Second)
+		checkGlobal(t, e, "fired", exp.fired, i)
+		checkGlobal(t, e, "ticks", exp.ticks, i)
+	}
+
+	// Missed runs of a repeating timer are skipped
+	clk.Advance(time.Minute)
+	checkGlobal(t, e, "ticks", "5", len(expected))
+
+	e.do(func(l *lua.LState) error {
+		return l.DoString(`require("timer").cancel(ticker)`)
+	})
+	clk.Advance(time.Minute)
+	checkGlobal(t, e, "ticks", "5", len(expected)+1)
+}
+
+func TestExec(t *testing.T) {
+	start := time.Now()
+	e := newTestEngine(t, baseConfig+`
+local exec = require("exec")
+
+result = {}
+result.code, result.stdout, result.stderr = exec.run{"sh", "-c", "echo out; echo $GREETING >&2; exit 3", env = {GREETING = "hello"}}
+
+local code, _, _, err = exec.run{"sleep", "5", timeout = 0.1}
+result.timeout_code = code
+result.timeout_err = err
+
+-- The shell's child keeps its stdout open, so it must be killed too
+local _, _, _, err = exec.run{"sh", "-c", "sleep 3; echo hi", timeout = 0.2}
+result.child_err = err
+
+exec.run_async({"echo", "async"}, function(code, stdout)
+	async_result = stdout
+end)
+`)
+
+	checkResult(t, e, map[string]string{
+		"code":         "3",
+		"stdout":       "out\n",
+		"stderr":       "hello\n",
+		"timeout_code": "nil",
+		"timeout_err":  "sleep: timed out after 100ms",
+		"child_err":    "sh: timed out after 200ms",
+	})
+
+	// Both commands were killed once they timed out
+	if elapsed := time.Since(start); elapsed >= 1*time.Second {
+		t.Errorf("Expected the commands to be killed within 1s, took %s", elapsed)
+	}
+
+	// The callback is called once the command exits
+	waitForGlobal(t, e, "async_result", "async\n")
+}
+
+func TestExecDryRun(t *testing.T) {
+	e := newTestEngine(t, baseConfig+`
+result = {}
+result.code, result.stdout = require("exec").run{"sh", "-c", "echo out; exit 3"}
+`, WithDryRun(true))
+
+	checkResult(t, e, map[string]string{
+		"code":   "0",
+		"stdout": "",
+	})
+}
+
+func TestHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(time.Second)
+		default:
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("X-Method", r.Method)
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, "%s %s %s", r.Header.Get("Content-Type"), r.Header.Get("X-Token"), body)
+		}
+	}))
+	defer server.Close()
+
+	e := newTestEngine(t, baseConfig+fmt.Sprintf("url = %q\n", server.URL)+`
+local http = require("http")
+
+result = {}
+
+local resp = http.get(url, {headers = {["X-Token"] = "secret"}})
+result.get_status = resp.status
+result.get_body = resp.body
+result.get_method = resp.headers["X-Method"]
+
+resp = http.post(url, {json = {uplink = "wan1", loss = 0.5, probes = {"a", "b"}}, source = "127.0.0.1"})
+result.post_body = resp.body
+
+resp = http.request{method = "PUT", url = url, body = "raw"}
+result.put_method = resp.headers["X-Method"]
+result.put_body = resp.body
+
+local _, err = http.get(url .. "/slow", {timeout = 0.1})
+result.timeout = err ~= nil
+
+http.request_async({url = url}, function(resp, err)
+	async_status = resp.status
+end)
+`)
+
+	checkResult(t, e, map[string]string{
+		"get_status": "201",
+		"get_body":   " secret ",
+		"get_method": "GET",
+		"post_body":  `application/json  {"loss":0.5,"probes":["a","b"],"uplink":"wan1"}`,
+		"put_method": "PUT",
+		"put_body":   "  raw",
+		"timeout":    "true",
+	})
+
+	waitForGlobal(t, e, "async_status", "201")
+}
+
+func TestHTTPDryRun(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer server.Close()
+
+	e := newTestEngine(t, baseConfig+fmt.Sprintf("url = %q\n", server.URL)+`
+local http = require("http")
+
+result = {}
+
+local resp = http.post(url, {json = {uplink = "wan1"}})
+result.status = resp.status
+result.body = resp.body
+
+http.request_async({url = url}, function(resp, err)
+	async_status = resp.status
+end)
+`, WithDryRun(true))
+
+	checkResult(t, e, map[string]string{
+		"status": "200",
+		"body":   "",
+	})
+
+	waitForGlobal(t, e, "async_status", "200")
+
+	if n := requests.Load(); n != 0 {
+		t.Errorf("Expected no requests to be sent, got %d", n)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	e := newTestEngine(t, baseConfig+`
+local json = require("json")
+
+result = {}
+result.array = json.encode({1, "two", true})
+result.object = json.encode({b = {c = 1}, a = json.null})
+result.empty = json.encode({})
+result.empty_array = json.encode(json.array())
+result.roundtrip = json.encode(json.decode('{"list":[],"nested":[{"x":null}],"n":1.5}'))
+
+local decoded = json.decode('[1, null, 3]')
+result.null = decoded[2] == json.null
+result.len = #decoded
+
+local _, err = json.decode("{")
+result.decode_error = err ~= nil
+result.encode_error = not pcall(json.encode, {f = print})
+
+function on_update(gps)
+	result.gps = json.encode(gps)
+	result.ps = json.encode(gps:get("192.168.0.1"))
+end
+`)
+
+	err := e.OnUpdate(ping.NewSnapshot(time.Unix(1000, 0), map[string]ping.ProbeStats{
+		"192.168.0.1": {Dst: "192.168.0.1", Loss: 50, Sent: 2, Received: 1, Started: time.Unix(990, 0)},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps := `{"dst":"192.168.0.1","failure_streak":0,"jitter":null,"last_failure":null,"last_success":null,"loss":50,` +
+		`"loss_ewma":0,"priority":0,"received":1,"rtt":null,"rtt_ewma":0,"rtt_max":null,"rtt_min":null,"rtt_p50":null,` +
+		`"rtt_p95":null,"rtt_p99":null,"sent":2,"src":"","started":990,"success_streak":0,"window_received":0,` +
+		`"window_sent":0,"windows":{}}`
+
+	checkResult(t, e, map[string]string{
+		"array":        `[1,"two",true]`,
+		"object":       `{"a":null,"b":{"c":1}}`,
+		"empty":        `{}`,
+		"empty_array":  `[]`,
+		"roundtrip":    `{"list":[],"n":1.5,"nested":[{"x":null}]}`,
+		"null":         "true",
+		"len":          "3",
+		"decode_error": "true",
+		"encode_error": "true",
+		"gps":          `{"probes":[` + ps + `],"timestamp":1000}`,
+		"ps":           ps,
+	})
+}
+
+func TestLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	e := newTestEngine(t, baseConfig+`
+logging = {level = "warn", format = "json", output = "journald"}
+
+local log = require("log")
+
+log.debug("hidden")
+log.info("switched uplink", {dst = "192.168.0.2", loss = 0.5, probes = {"a", "b"}})
+log.error("failed")
+`, WithLogger(logger))
+
+	if e.Config.Logging != (LoggingConfig{Level: "warn", Format: "json", Output: "journald"}) {
+		t.Errorf("Unexpected logging config: %+v", e.Config.Logging)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", buf.String())
+	}
+
+	var rec map[string]interface{}
+	err := json.Unmarshal([]byte(lines[0]), &rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec["msg"] != "switched uplink" || rec["dst"] != "192.168.0.2" || rec["loss"] != 0.5 || fmt.Sprint(rec["probes"]) != "[a b]" {
+		t.Errorf("Unexpected record: %v", rec)
+	}
+
+	if !strings.Contains(lines[1], `"level":"ERROR"`) {
+		t.Errorf("Expected an error record, got %s", lines[1])
+	}
+}
+
+func TestState(t *testing.T) {
+	e := newTestEngine(t, baseConfig+`
+state = {path = "/var/lib/failoverd/state.json", max_age = 60}
+
+local state = require("state")
+
+-- Set at load time, so it should not be overwritten by the restored value
+state.set("loaded", true)
+
+function on_update(gps)
+	result = {}
+	result.restored = state.get("active")
+	result.loaded = state.get("loaded")
+	result.missing = state.get("missing")
+
+	state.set("active", "192.168.0.2")
+	state.set("history", {"192.168.0.1", "192.168.0.2"})
+	state.set("old", nil)
+	result.history = state.get("history")[2]
+	result.error = not pcall(state.set, "f", print)
+end
+`)
+
+	expected := StateConfig{Configured: true, Path: "/var/lib/failoverd/state.json", MaxAge: 60 * time.Second, SaveInterval: 30 * time.Second}
+	if e.Config.State != expected {
+		t.Errorf("Unexpected state config: %+v", e.Config.State)
+	}
+
+	err := e.RestoreValues(map[string]interface{}{"active": "192.168.0.1", "loaded": false, "old": 1.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = e.OnUpdate(ping.NewSnapshot(time.Unix(1000, 0), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkResult(t, e, map[string]string{
+		"restored": "192.168.0.1",
+		"loaded":   "true",
+		"missing":  "nil",
+		"history":  "192.168.0.2",
+		"error":    "true",
+	})
+
+	values, err := e.Values()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(values) != "map[active:192.168.0.2 history:[192.168.0.1 192.168.0.2] loaded:true]" {
+		t.Errorf("Unexpected values: %v", values)
+	}
+}
+
+func TestRecordConfigWithoutPath(t *testing.T) {
+	// The path is given on the command line instead
+	e := newTestEngine(t, baseConfig+`
+record = {max_size = 1000, max_files = 2}
+`)
+
+	expected := RecordConfig{Configured: true, MaxSize: 1000, MaxFiles: 2}
+	if e.Config.Record != expected {
+		t.Errorf("Unexpected record config: %+v", e.Config.Record)
+	}
+}
+
+func TestRestoredValuesAtLoad(t *testing.T) {
+	e := newTestEngine(t, baseConfig+`
+-- The path is given on the command line instead
+state = {max_age = 60}
+
+local state = require("state")
+
+result = {}
+result.restored = state.get("active")
+
+state.set("active", "192.168.0.2")
+`, WithRestoredValues(map[string]interface{}{"active": "192.168.0.1"}))
+
+	expected := StateConfig{Configured: true, MaxAge: 60 * time.Second, SaveInterval: 30 * time.Second}
+	if e.Config.State != expected {
+		t.Errorf("Unexpected state config: %+v", e.Config.State)
+	}
+
+	checkResult(t, e, map[string]string{
+		"restored": "192.168.0.1",
+	})
+
+	values, err := e.Values()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(values) != "map[active:192.168.0.2]" {
+		t.Errorf("Unexpected values: %v", values)
+	}
+}
+
+// testEventRecorder collects the events recorded by an Engine
+type testEventRecorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *testEventRecorder) RecordEvent(typ string, dst string, message string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, fmt.Sprintf("%s %s %s", typ, dst, message))
+}
+
+func TestEvents(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	e := newTestEngine(t, baseConfig+`
+local timer = require("timer")
+
+function on_update(gps)
+	failoverd.event("route_changed", "default via 192.168.0.2")
+	timer.after(1, function()
+		error("timer failed")
+	end)
+end
+
+function on_event(ev)
+	result = {
+		id = ev.id,
+		time = ev.time,
+		type = ev.type,
+		dst = ev.dst,
+		message = ev.message,
+		probes = #ev.stats:all(),
+		recursive = not pcall(failoverd.event, "nested"),
+	}
+end
+`, WithClock(clk))
+
+	recorder := &testEventRecorder{}
+	e.SetEventRecorder(recorder)
+
+	err := e.OnUpdate(ping.NewSnapshot(clk.Now(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clk.Advance(1 * time.Second)
+
+	err = e.OnEvent(events.Event{
+		ID:    3,
+		Time:  clk.Now(),
+		Type:  events.ProbeStarted,
+		Dst:   "192.168.0.1",
+		Stats: ping.NewSnapshot(clk.Now(), map[string]ping.ProbeStats{"192.168.0.1": {Dst: "192.168.0.1"}}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkResult(t, e, map[string]string{
+		"id":        "3",
+		"time":      "1001",
+		"type":      "probe_started",
+		"dst":       "192.168.0.1",
+		"message":   "nil",
+		"probes":    "1",
+		"recursive": "true",
+	})
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	if len(recorder.events) != 2 || recorder.events[0] != "route_changed  default via 192.168.0.2" ||
+		!strings.HasPrefix(recorder.events[1], "callback_error  error calling timer callback: ") {
+		t.Errorf("Unexpected events: %q", recorder.events)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	e := newTestEngine(t, baseConfig+`
+local json = require("json")
+
+result = {
+	io = io == nil,
+	execute = os.execute == nil,
+	remove = os.remove == nil,
+	time = type(os.time()),
+	dofile = dofile == nil,
+	exec = not pcall(require, "exec"),
+	json = json.encode({1}),
+	recursion = not pcall(function()
+		local function f()
+			return f() + 1
+		end
+		return f()
+	end),
+}
+
+function on_update(gps)
+	while true do
+	end
+end
+`, WithSandbox(Sandbox{Modules: []string{"json"}, Timeout: 100 * time.Millisecond}))
+
+	checkResult(t, e, map[string]string{
+		"io":        "true",
+		"execute":   "true",
+		"remove":    "true",
+		"time":      "number",
+		"dofile":    "true",
+		"exec":      "true",
+		"json":      "[1]",
+		"recursion": "true",
+	})
+
+	err := e.OnUpdate(ping.NewSnapshot(time.Now(), nil))
+	if err == nil || !strings.Contains(err.Error(), "timed out after 100ms") {
+		t.Fatalf("Expected on_update to time out, got %v", err)
+	}
+
+	// The Engine is still usable after a callback times out
+	checkResult(t, e, map[string]string{"json": "[1]"})
+
+	path := filepath.Join(t.TempDir(), "config.lua")
+	os.WriteFile(path, []byte(baseConfig), 0o644)
+
+	_, err = New(path, WithSandbox(Sandbox{Modules: []string{"bogus"}}))
+	if err == nil {
+		t.Fatal("Expected an error for an unknown sandbox module")
+	}
+}
+
+func TestSandboxLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		sandbox  Sandbox
+		onUpdate string
+		err      string
+	}{
+		{
+			name:     "instructions",
+			sandbox:  Sandbox{MaxInstructions: 10000},
+			onUpdate: "while true do end",
+			err:      "sandbox: instruction limit of 10000 exceeded",
+		},
+		{
+			name:     "string.rep",
+			sandbox:  Sandbox{MaxMemory: 16 << 20},
+			onUpdate: `local s = string.rep("x", 1e9)`,
+			err:      "string.rep: result would exceed the sandbox memory limit of 16777216 bytes",
+		},
+		{
+			name:     "rep method",
+			sandbox:  Sandbox{MaxMemory: 16 << 20},
+			onUpdate: `local s = ("x"):rep(1e9)`,
+			err:      "string.rep: result would exceed the sandbox memory limit of 16777216 bytes",
+		},
+		{
+			name:     "string.gsub",
+			sandbox:  Sandbox{MaxMemory: 16 << 20},
+			onUpdate: `local s = string.gsub(string.rep("x", 10000), ".", string.rep("y", 10000))`,
+			err:      "string.gsub: result would exceed the sandbox memory limit of 16777216 bytes",
+		},
+		{
+			name:     "string.format",
+			sandbox:  Sandbox{MaxMemory: 16 << 20},
+			onUpdate: `local s = string.format("%999999999d", 1)`,
+			err:      "string.format: invalid format (width or precision too long)",
+		},
+		{
+			name:    "table.concat",
+			sandbox: Sandbox{MaxMemory: 16 << 20},
+			onUpdate: `local t, x = {}, string.rep("x", 1000000)
+	for i = 1, 100 do t[i] = x end
+	local s = table.concat(t)`,
+			err: "table.concat: result would exceed the sandbox memory limit of 16777216 bytes",
+		},
+		{
+			name:    "concatenation",
+			sandbox: Sandbox{MaxMemory: 16 << 20},
+			onUpdate: `local s = "x"
+	for i = 1, 40 do s = s .. s end`,
+			err: "sandbox: memory limit of 16777216 bytes exceeded",
+		},
+		{
+			name:    "tables",
+			sandbox: Sandbox{MaxMemory: 16 << 20},
+			onUpdate: `local t = {}
+	for i = 1, 1e9 do t[i] = {i} end`,
+			err: "sandbox: memory limit of 16777216 bytes exceeded",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sandbox := tt.sandbox
+			sandbox.Timeout = 10 * time.Second
+
+			e := newTestEngine(t, baseConfig+`
+result = {
+	format = string.format("%5.2f|%-10s|", 1.5, "a"),
+	rep = ("ab"):rep(3, ","),
+	gsub = (string.gsub("a b", " ", "%0%0")),
+	concat = table.concat({1, "b"}, ","),
+}
+
+function on_update(gps)
+	`+tt.onUpdate+`
+end
+`, WithSandbox(sandbox))
+
+			// Scripts that stay within the limits are unaffected
+			checkResult(t, e, map[string]string{
+				"format": " 1.50|a         |",
+				"rep":    "ababab",
+				"gsub":   "a  b",
+				"concat": "1,b",
+			})
+
+			err := e.OnUpdate(ping.NewSnapshot(time.Now(), nil))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Expected an error containing %q, got %v", tt.err, err)
+			}
+
+			// The Engine is still usable after a callback exceeds a limit
+			checkResult(t, e, map[string]string{"concat": "1,b"})
+		})
+	}
+}
+
+func TestCallbackErrorPolicies(t *testing.T) {
+	snapshot := ping.NewSnapshot(time.Unix(1000, 0), nil)
+
+	e := newTestEngine(t, baseConfig+`
+callbacks = {on_error = "disable", max_failures = 2}
+
+function on_update(gps)
+	error("failed")
+end
+
+function on_quit(gps)
+	result = {
+		errors = failoverd.callback_stats().on_update.errors,
+		disabled = failoverd.callback_stats().on_update.disabled,
+	}
+end
+`)
+
+	for i := 0; i < 2; i++ {
+		if err := e.OnUpdate(snapshot); err == nil {
+			t.Fatalf("Call %d: expected on_update to fail", i)
+		}
+	}
+
+	if err := e.OnUpdate(snapshot); err != nil {
+		t.Fatalf("Expected on_update to be disabled, got %v", err)
+	}
+
+	cs := e.CallbackStats()["on_update"]
+	if cs.Calls != 2 || cs.Errors != 2 || cs.ConsecutiveErrors != 2 || !cs.Disabled || !strings.Contains(cs.LastError, "failed") {
+		t.Errorf("Unexpected callback stats: %+v", cs)
+	}
+
+	if err := e.OnQuit(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	checkResult(t, e, map[string]string{
+		"errors":   "2",
+		"disabled": "true",
+	})
+
+	e = newTestEngine(t, baseConfig+`
+callbacks = {on_error = "count"}
+
+function on_update(gps)
+	error("failed")
+end
+`)
+
+	if err := e.OnUpdate(snapshot); err != nil {
+		t.Fatalf("Expected errors to only be counted, got %v", err)
+	}
+
+	if cs := e.CallbackStats()["on_update"]; cs.Errors != 1 {
+		t.Errorf("Expected 1 error, got %d", cs.Errors)
+	}
+
+	e = newTestEngine(t, baseConfig+`
+callbacks = {on_error = "exit", max_failures = 1}
+
+function on_update(gps)
+	error("failed")
+end
+`)
+
+	e.OnUpdate(snapshot)
+
+	select {
+	case err := <-e.Fatal():
+		if !strings.Contains(err.Error(), "on_update failed 1 times in a row") {
+			t.Errorf("Unexpected fatal error: %v", err)
+		}
+	default:
+		t.Fatal("Expected a fatal error")
+	}
+}
+
+func TestCallbackTimeout(t *testing.T) {
+	e := newTestEngine(t, baseConfig+`
+callbacks = {timeout = 0.1}
+
+function on_update(gps)
+	os.execute("sleep 5")
+	done = true
+end
+`)
+
+	start := time.Now()
+	err := e.OnUpdate(ping.NewSnapshot(time.Unix(1000, 0), nil))
+	if err == nil || !strings.Contains(err.Error(), "timed out after 100ms") {
+		t.Fatalf("Expected on_update to time out, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Expected the command to be killed, but on_update took %v", elapsed)
+	}
+
+	checkGlobal(t, e, "done", "nil", 0)
+}
+
+func TestCallbackTimeoutExec(t *testing.T) {
+	e := newTestEngine(t, baseConfig+`
+callbacks = {timeout = 0.2}
+
+local exec = require("exec")
+
+function on_recv(gps, ps)
+	exec.run({"sh", "-c", "sleep 3; echo done"})
+	done = true
+end
+`)
+
+	// The sleep holds the shell's stdout open, so it must be killed along with the shell
+	start := time.Now()
+	err := e.OnRecv(ping.Snapshot{}, ping.ProbeStats{Dst: "192.168.0.1"})
+	if err == nil || !strings.Contains(err.Error(), "timed out after 200ms") {
+		t.Fatalf("Expected on_recv to time out, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected the command to be killed, but on_recv took %v", elapsed)
+	}
+
+	checkGlobal(t, e, "done", "nil", 0)
+}
+
+func TestCoroutineAcrossCallbacks(t *testing.T) {
+	tests := []struct {
+		name     string
+		callback string
+	}{
+		{"without timeout", ""},
+		{"with timeout", "callbacks = {timeout = 1}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Both coroutines are created in the first call, and resumed in every later one
+			e := newTestEngine(t, baseConfig+tt.callback+`
+local function counter()
+	local n = 0
+	while true do
+		n = n + 1
+		coroutine.yield(n)
+	end
+end
+
+function on_update(gps)
+	if not wrapped then
+		wrapped = coroutine.wrap(counter)
+		co = coroutine.create(counter)
+	end
+
+	result = {}
+	result.wrapped = wrapped()
+	local ok, n = coroutine.resume(co)
+	result.ok = ok
+	result.resumed = n
+end
+`)
+
+			for i := 1; i <= 3; i++ {
+				err := e.OnUpdate(ping.NewSnapshot(time.Unix(1000, 0), nil))
+				if err != nil {
+					t.Fatalf("Call %d: %v", i, err)
+				}
+
+				checkResult(t, e, map[string]string{
+					"wrapped": fmt.Sprint(i),
+					"ok":      "true",
+					"resumed": fmt.Sprint(i),
+				})
+			}
+		})
+	}
+}
+
+func TestCoroutineTimeout(t *testing.T) {
+	// The coroutine is created without a timeout, while the script is loaded
+	e := newTestEngine(t, baseConfig+`
+callbacks = {timeout = 0.1}
+
+spin = coroutine.wrap(function()
+	while true do end
+end)
+
+function on_update(gps)
+	spin()
+end
+`)
+
+	err := e.OnUpdate(ping.NewSnapshot(time.Unix(1000, 0), nil))
+	if err == nil || !strings.Contains(err.Error(), "timed out after 100ms") {
+		t.Fatalf("Expected on_update to time out, got %v", err)
+	}
+}
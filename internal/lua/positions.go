@@ -0,0 +1,155 @@
+package lua
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// sourcePositions records where settings are set in a configuration script,
+// so that errors about their values can point at the line that set them.
+type sourcePositions struct {
+	file  string
+	lines map[string]int   // Line at which each setting was last set
+	items map[string][]int // Lines of the positional items of settings set to a table constructor
+}
+
+func newSourcePositions(file string) sourcePositions {
+	return sourcePositions{
+		file:  file,
+		lines: make(map[string]int),
+		items: make(map[string][]int),
+	}
+}
+
+// parsePositions parses a script to find the positions of its settings. globals holds the
+// positions of top-level assignments to globals, and fields holds the positions of the fields
+// of a table constructor passed to failoverd.setup or returned by the script.
+// Problems reading or parsing the file are ignored; DoFile has already reported them.
+func parsePositions(file string) (globals sourcePositions, fields sourcePositions) {
+	globals = newSourcePositions(file)
+	fields = newSourcePositions(file)
+
+	f, err := os.Open(file)
+	if err != nil {
+		return globals, fields
+	}
+	defer f.Close()
+
+	chunk, err := parse.Parse(f, file)
+	if err != nil {
+		return globals, fields
+	}
+
+	for _, stmt := range chunk {
+		switch stmt := stmt.(type) {
+		case *ast.AssignStmt:
+			for i, lhs := range stmt.Lhs {
+				ident, ok := lhs.(*ast.IdentExpr)
+				if !ok {
+					continue
+				}
+
+				var rhs ast.Expr
+				if i < len(stmt.Rhs) {
+					rhs = stmt.Rhs[i]
+				}
+				globals.set(ident.Value, stmt.Line(), rhs)
+			}
+		case *ast.FuncDefStmt:
+			if ident, ok := stmt.Name.Func.(*ast.IdentExpr); ok {
+				globals.set(ident.Value, stmt.Line(), nil)
+			}
+		case *ast.FuncCallStmt:
+			if table, ok := setupArgument(stmt.Expr); ok {
+				fields.setFields(table)
+			}
+		case *ast.ReturnStmt:
+			if len(stmt.Exprs) > 0 {
+				if table, ok := stmt.Exprs[0].(*ast.TableExpr); ok {
+					fields.setFields(table)
+				}
+			}
+		}
+	}
+
+	return globals, fields
+}
+
+// setupArgument returns the table constructor passed to failoverd.setup by a function call, if any
+func setupArgument(expr ast.Expr) (*ast.TableExpr, bool) {
+	call, ok := expr.(*ast.FuncCallExpr)
+	if !ok || len(call.Args) != 1 {
+		return nil, false
+	}
+
+	attr, ok := call.Func.(*ast.AttrGetExpr)
+	if !ok {
+		return nil, false
+	}
+
+	object, ok := attr.Object.(*ast.IdentExpr)
+	if !ok || object.Value != "failoverd" {
+		return nil, false
+	}
+
+	key, ok := attr.Key.(*ast.StringExpr)
+	if !ok || key.Value != "setup" {
+		return nil, false
+	}
+
+	table, ok := call.Args[0].(*ast.TableExpr)
+	return table, ok
+}
+
+// set records that a setting was set at the given line to the given expression, which may be nil
+func (p sourcePositions) set(name string, line int, value ast.Expr) {
+	p.lines[name] = line
+	delete(p.items, name)
+
+	table, ok := value.(*ast.TableExpr)
+	if !ok {
+		return
+	}
+
+	lines := []int{}
+	for _, field := range table.Fields {
+		if field.Key == nil {
+			lines = append(lines, field.Value.Line())
+		}
+	}
+	p.items[name] = lines
+}
+
+// setFields records the named fields of a table constructor as settings
+func (p sourcePositions) setFields(table *ast.TableExpr) {
+	for _, field := range table.Fields {
+		if key, ok := field.Key.(*ast.StringExpr); ok {
+			p.set(key.Value, key.Line(), field.Value)
+		}
+	}
+}
+
+// of returns the position of a setting in the same format as LState.Where,
+// e.g. "config.lua:3:". Only the file name is returned if the position is not known.
+func (p sourcePositions) of(name string) string {
+	line, ok := p.lines[name]
+	if !ok {
+		return p.file + ":"
+	}
+
+	return fmt.Sprintf("%s:%d:", p.file, line)
+}
+
+// item returns the position of the i-th (1-based) positional item of a table setting,
+// falling back to the position of the setting itself.
+func (p sourcePositions) item(name string, i int) string {
+	lines := p.items[name]
+	if i < 1 || i > len(lines) {
+		return p.of(name)
+	}
+
+	return fmt.Sprintf("%s:%d:", p.file, lines[i-1])
+}
@@ -0,0 +1,341 @@
+package lua
+
+import (
+	"context"
+	"fmt"
+	"runtime/metrics"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Sandbox restricts what a configuration script can do, for scripts that are not fully trusted.
+//
+// Only the base (without dofile and loadfile), coroutine, math, string and table libraries are
+// available, along with os.clock, os.date, os.difftime and os.time. Lua files cannot be required.
+type Sandbox struct {
+	// Modules lists the modules (e.g. "json") that scripts may require
+	Modules []string
+
+	// Timeout limits how long loading the script, and each callback, may run before it is aborted.
+	// There is no limit if it is zero.
+	Timeout time.Duration
+
+	// MaxInstructions limits the number of Lua instructions that loading the script, and each
+	// callback, may run before it is aborted. There is no limit if it is zero.
+	MaxInstructions uint64
+
+	// MaxMemory limits the number of bytes that loading the script, and each callback, may allocate
+	// before it is aborted, including memory that has since been freed. There is no limit if it is zero.
+	MaxMemory uint64
+}
+
+// DefaultSandboxModules are the modules that cannot affect anything outside of failoverd.
+var DefaultSandboxModules = []string{"dns", "json", "log", "state", "timer"}
+
+const (
+	DefaultSandboxTimeout         = 5 * time.Second
+	DefaultSandboxMaxInstructions = 10000000
+	DefaultSandboxMaxMemory       = 64 << 20
+)
+
+const (
+	// Limits on the depth of Lua calls and on the number of values on the Lua stack, which bound
+	// runaway recursion
+	sandboxCallStackSize   = 200
+	sandboxRegistrySize    = 256 * 20
+	sandboxRegistryMaxSize = 256 * 20 * 16
+
+	// How often the memory allocated by a sandboxed callback is measured. Reading it is too slow to
+	// do before every instruction, and a millisecond is too short to allocate much.
+	sandboxMemoryCheckInterval = 1 * time.Millisecond
+
+	// The number of digits allowed in string.format's widths and precisions, as in standard Lua
+	sandboxMaxFormatDigits = 2
+)
+
+// closedChan is returned by sandboxContext.Done once a limit has been exceeded
+var closedChan = make(chan struct{})
+
+func init() {
+	close(closedChan)
+}
+
+// sandboxContext is the context of a sandboxed script while it is loaded or runs a callback.
+// gopher-lua calls the Done method of a state's context before every instruction, so Done
+// counts instructions, and reports that the context is done once a limit has been exceeded.
+// The memory allocated is measured by a separate goroutine.
+type sandboxContext struct {
+	context.Context
+
+	maxInstructions uint64
+	instructions    atomic.Uint64
+	err             atomic.Pointer[error] // Set once a limit has been exceeded
+	stop            chan struct{}
+}
+
+func newSandboxContext(parent context.Context, s Sandbox) *sandboxContext {
+	c := &sandboxContext{
+		Context:         parent,
+		maxInstructions: s.MaxInstructions,
+		stop:            make(chan struct{}),
+	}
+
+	if s.MaxMemory > 0 {
+		go c.watchMemory(s.MaxMemory, allocatedBytes())
+	}
+
+	return c
+}
+
+func (c *sandboxContext) Done() <-chan struct{} {
+	if c.err.Load() != nil {
+		return closedChan
+	}
+
+	if n := c.instructions.Add(1); c.maxInstructions > 0 && n > c.maxInstructions {
+		c.fail(fmt.Errorf("sandbox: instruction limit of %d exceeded", c.maxInstructions))
+		return closedChan
+	}
+
+	return c.Context.Done()
+}
+
+func (c *sandboxContext) Err() error {
+	if err := c.err.Load(); err != nil {
+		return *err
+	}
+
+	return c.Context.Err()
+}
+
+// fail records the first limit to be exceeded
+func (c *sandboxContext) fail(err error) {
+	c.err.CompareAndSwap(nil, &err)
+}
+
+// watchMemory fails the context once more than maxMemory bytes have been allocated since start.
+// Memory allocated by other goroutines in the meantime is counted too, so the limit is approximate.
+func (c *sandboxContext) watchMemory(maxMemory uint64, start uint64) {
+	ticker := time.NewTicker(sandboxMemoryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if allocatedBytes()-start > maxMemory {
+				c.fail(fmt.Errorf("sandbox: memory limit of %d bytes exceeded", maxMemory))
+				return
+			}
+		}
+	}
+}
+
+// close stops measuring the memory allocated, once the script or callback has returned
+func (c *sandboxContext) close() {
+	close(c.stop)
+}
+
+// allocatedBytes returns the number of bytes allocated on the heap since the process started
+func allocatedBytes() uint64 {
+	sample := []metrics.Sample{{Name: "/gc/heap/allocs:bytes"}}
+	metrics.Read(sample)
+	return sample[0].Value.Uint64()
+}
+
+// WithSandbox runs the configuration script in a sandbox.
+func WithSandbox(s Sandbox) Option {
+	return func(e *Engine) {
+		e.sandbox = &s
+		e.timeout = s.Timeout
+	}
+}
+
+// newSandboxedState returns a Lua state with only the libraries allowed by Sandbox
+func newSandboxedState(s Sandbox) *lua.LState {
+	l := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   sandboxCallStackSize,
+		RegistrySize:    sandboxRegistrySize,
+		RegistryMaxSize: sandboxRegistryMaxSize,
+	})
+
+	// As in lua.OpenLibs, package and the base library must be opened first
+	libs := []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.LoadLibName, lua.OpenPackage},
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.CoroutineLibName, lua.OpenCoroutine},
+		{lua.MathLibName, lua.OpenMath},
+		{lua.OsLibName, lua.OpenOs},
+		{lua.StringLibName, lua.OpenString},
+		{lua.TabLibName, lua.OpenTable},
+	}
+
+	for _, lib := range libs {
+		l.Push(l.NewFunction(lib.open))
+		l.Push(lua.LString(lib.name))
+		l.Call(1, 0)
+	}
+
+	l.SetGlobal("dofile", lua.LNil)
+	l.SetGlobal("loadfile", lua.LNil)
+
+	// Only the preloader is kept, so that modules can be required but Lua files cannot
+	if loaders, ok := l.GetField(l.Get(lua.RegistryIndex), "_LOADERS").(*lua.LTable); ok {
+		for i := loaders.Len(); i > 1; i-- {
+			loaders.RawSetInt(i, lua.LNil)
+		}
+	}
+
+	// Only the parts of os that tell the time
+	osModule := l.GetGlobal("os").(*lua.LTable)
+	sandboxedOS := l.NewTable()
+	for _, name := range []string{"clock", "date", "difftime", "time"} {
+		sandboxedOS.RawSetString(name, osModule.RawGetString(name))
+	}
+	l.SetGlobal("os", sandboxedOS)
+	l.SetField(l.GetField(l.Get(lua.RegistryIndex), "_LOADED"), "os", sandboxedOS)
+
+	if s.MaxMemory > 0 {
+		limitStringBuilding(l, s.MaxMemory)
+	}
+
+	return l
+}
+
+// limitStringBuilding replaces the library functions that can build a large string in a single
+// call, which the memory limit would only catch after it had been allocated, with ones that check
+// the size of their result first. The string library is also strings' metatable's __index, so
+// methods such as ("x"):rep(n) are replaced too.
+func limitStringBuilding(l *lua.LState, maxMemory uint64) {
+	stringModule := l.GetGlobal("string").(*lua.LTable)
+	tableModule := l.GetGlobal("table").(*lua.LTable)
+
+	checkSize := func(l *lua.LState, fn string, size float64) {
+		if size > float64(maxMemory) {
+			l.RaiseError("%s: result would exceed the sandbox memory limit of %d bytes", fn, maxMemory)
+		}
+	}
+
+	rep := stringModule.RawGetString("rep").(*lua.LFunction)
+	l.SetField(stringModule, "rep", l.NewFunction(func(l *lua.LState) int {
+		checkSize(l, "string.rep", float64(len(l.CheckString(1)))*float64(l.CheckInt(2)))
+		return rep.GFunction(l)
+	}))
+
+	// The replacement can refer to the whole match or a capture, each of which is at most the
+	// whole string, and there can be one more match than there are characters
+	gsub := stringModule.RawGetString("gsub").(*lua.LFunction)
+	l.SetField(stringModule, "gsub", l.NewFunction(func(l *lua.LState) int {
+		str := l.CheckString(1)
+		if repl, ok := l.Get(3).(lua.LString); ok {
+			matches := float64(len(str) + 1)
+			if n, ok := l.Get(4).(lua.LNumber); ok && float64(n) < matches {
+				matches = float64(n)
+			}
+
+			perMatch := float64(len(repl)) + float64(strings.Count(string(repl), "%"))*float64(len(str))
+			checkSize(l, "string.gsub", float64(len(str))+matches*perMatch)
+		}
+		return gsub.GFunction(l)
+	}))
+
+	format := stringModule.RawGetString("format").(*lua.LFunction)
+	l.SetField(stringModule, "format", l.NewFunction(func(l *lua.LState) int {
+		if !formatWidthsValid(l.CheckString(1)) {
+			l.RaiseError("string.format: invalid format (width or precision too long)")
+		}
+		return format.GFunction(l)
+	}))
+
+	concat := tableModule.RawGetString("concat").(*lua.LFunction)
+	l.SetField(tableModule, "concat", l.NewFunction(func(l *lua.LState) int {
+		table := l.CheckTable(1)
+		sep := l.OptString(2, "")
+		i := l.OptInt(3, 1)
+		j := l.OptInt(4, table.Len())
+
+		// As table.concat does, only the values in the table's sequence are joined. Values that
+		// cannot be joined are left for it to report.
+		if i < 1 {
+			i = 1
+		}
+		if j > table.Len() {
+			j = table.Len()
+		}
+
+		size := 0.0
+		for ; i <= j; i++ {
+			switch v := table.RawGetInt(i).(type) {
+			case lua.LString:
+				size += float64(len(v) + len(sep))
+			case lua.LNumber:
+				size += float64(len(v.String()) + len(sep))
+			}
+		}
+
+		checkSize(l, "table.concat", size)
+		return concat.GFunction(l)
+	}))
+}
+
+// formatWidthsValid reports whether every width and precision in a string.format format has
+// at most sandboxMaxFormatDigits digits, so that a single directive cannot produce a huge string
+func formatWidthsValid(format string) bool {
+	digits := func(i int) int {
+		n := 0
+		for i+n < len(format) && format[i+n] >= '0' && format[i+n] <= '9' {
+			n++
+		}
+		return n
+	}
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+
+		i++
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+			i++
+		}
+
+		n := digits(i)
+		if n > sandboxMaxFormatDigits {
+			return false
+		}
+		i += n
+
+		if i < len(format) && format[i] == '.' {
+			n = digits(i + 1)
+			if n > sandboxMaxFormatDigits {
+				return false
+			}
+			i += 1 + n
+		}
+	}
+
+	return true
+}
+
+// allowsModule reports whether a module may be required
+func (s *Sandbox) allowsModule(name string) bool {
+	if s == nil {
+		return true
+	}
+
+	for _, allowed := range s.Modules {
+		if allowed == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,98 @@
+package lua
+
+import (
+	"encoding/json"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func (e *Engine) stateLoader(l *lua.LState) int {
+	module := l.SetFuncs(l.NewTable(), map[string]lua.LGFunction{
+		"get": e.stateGet,
+		"set": e.stateSet,
+	})
+	l.Push(module)
+	return 1
+}
+
+// stateGet returns the value saved under a key, or nil if there is none
+func (e *Engine) stateGet(l *lua.LState) int {
+	key := l.CheckString(1)
+
+	l.Push(fromJSONValue(l, e.values[key], lua.LNil))
+	return 1
+}
+
+// stateSet saves a value under a key, or removes the key if the value is nil. Values must be
+// convertible to JSON, since that is how they are saved.
+func (e *Engine) stateSet(l *lua.LState) int {
+	key := l.CheckString(1)
+	val := l.CheckAny(2)
+
+	if val == lua.LNil {
+		delete(e.values, key)
+		return 0
+	}
+
+	v, err := toJSONValue(l, val)
+	if err != nil {
+		l.ArgError(2, err.Error())
+		return 0
+	}
+
+	// Round trip through JSON, so that values read back before a restart are the same as after it
+	b, err := json.Marshal(v)
+	if err != nil {
+		l.ArgError(2, err.Error())
+		return 0
+	}
+
+	var saved interface{}
+	err = json.Unmarshal(b, &saved)
+	if err != nil {
+		l.ArgError(2, err.Error())
+		return 0
+	}
+
+	e.values[key] = saved
+	return 0
+}
+
+// Values returns a copy of the values saved with state.set, for saving across restarts.
+func (e *Engine) Values() (map[string]interface{}, error) {
+	var values map[string]interface{}
+
+	err := e.do(func(_ *lua.LState) error {
+		values = make(map[string]interface{}, len(e.values))
+		for key, val := range e.values {
+			values[key] = val
+		}
+		return nil
+	})
+
+	return values, err
+}
+
+// WithRestoredValues makes state.get return values saved before a restart, even while the
+// configuration script is being loaded. Values must be as decoded by encoding/json.
+func WithRestoredValues(values map[string]interface{}) Option {
+	return func(e *Engine) {
+		for key, val := range values {
+			e.values[key] = val
+		}
+	}
+}
+
+// RestoreValues restores values saved before a restart, for when they could not be given to New
+// with WithRestoredValues. Keys that the script has already set with state.set keep their values.
+// Values must be as decoded by encoding/json.
+func (e *Engine) RestoreValues(values map[string]interface{}) error {
+	return e.do(func(_ *lua.LState) error {
+		for key, val := range values {
+			if _, ok := e.values[key]; !ok {
+				e.values[key] = val
+			}
+		}
+		return nil
+	})
+}
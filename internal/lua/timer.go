@@ -0,0 +1,190 @@
+package lua
+
+import (
+	"time"
+
+	"github.com/sector-f/failoverd/internal/clock"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// A luaTimer is a callback scheduled by timer.after or timer.every
+type luaTimer struct {
+	id       int
+	deadline time.Time
+	interval time.Duration // Zero if the timer only fires once
+	fn       *lua.LFunction
+}
+
+// timers holds the callbacks scheduled by the `timer` module. Like the Lua state, it is only
+// touched by the goroutine that runs Lua code: the dispatcher, or the caller of New.
+type timers struct {
+	clock   clock.Clock
+	nextID  int
+	pending map[int]*luaTimer
+
+	wakeup   clock.Timer // Fires at wakeupAt, the earliest deadline. nil if there are no timers.
+	wakeupAt time.Time
+}
+
+func newTimers(c clock.Clock) *timers {
+	return &timers{
+		clock:   c,
+		pending: make(map[int]*luaTimer),
+	}
+}
+
+func (t *timers) add(d time.Duration, interval time.Duration, fn *lua.LFunction) int {
+	t.nextID++
+	t.pending[t.nextID] = &luaTimer{
+		id:       t.nextID,
+		deadline: t.clock.Now().Add(d),
+		interval: interval,
+		fn:       fn,
+	}
+
+	return t.nextID
+}
+
+func (t *timers) cancel(id int) bool {
+	_, ok := t.pending[id]
+	delete(t.pending, id)
+	return ok
+}
+
+// next returns the timer with the earliest deadline, breaking ties by creation order
+func (t *timers) next() *luaTimer {
+	var next *luaTimer
+	for _, timer := range t.pending {
+		if next == nil || timer.deadline.Before(next.deadline) || (timer.deadline.Equal(next.deadline) && timer.id < next.id) {
+			next = timer
+		}
+	}
+
+	return next
+}
+
+// due removes and returns the earliest timer whose deadline has passed, rescheduling it first
+// if it repeats. ok is false if no timers are due.
+func (t *timers) due() (timer luaTimer, ok bool) {
+	next := t.next()
+	if next == nil || next.deadline.After(t.clock.Now()) {
+		return luaTimer{}, false
+	}
+
+	timer = *next
+
+	if next.interval > 0 {
+		// If the engine was busy for more than an interval, skip the missed runs rather than catching up
+		next.deadline = next.deadline.Add(next.interval)
+		if !next.deadline.After(t.clock.Now()) {
+			next.deadline = t.clock.Now().Add(next.interval)
+		}
+	} else {
+		delete(t.pending, next.id)
+	}
+
+	return timer, true
+}
+
+// reschedule makes the wakeup timer fire at the earliest deadline
+func (t *timers) reschedule() {
+	next := t.next()
+
+	if t.wakeup != nil {
+		if next != nil && next.deadline.Equal(t.wakeupAt) {
+			return
+		}
+
+		t.wakeup.Stop()
+		t.wakeup = nil
+	}
+
+	if next == nil {
+		return
+	}
+
+	t.wakeupAt = next.deadline
+	t.wakeup = t.clock.NewTimer(next.deadline.Sub(t.clock.Now()))
+}
+
+// wakeupC returns the channel of the wakeup timer, or nil if there are no timers
+func (t *timers) wakeupC() <-chan time.Time {
+	if t.wakeup == nil {
+		return nil
+	}
+
+	return t.wakeup.C()
+}
+
+// stop stops the wakeup timer
+func (t *timers) stop() {
+	if t.wakeup != nil {
+		t.wakeup.Stop()
+		t.wakeup = nil
+	}
+}
+
+// runTimers calls the callbacks of every timer that is due, in deadline order.
+// Errors are logged, since there is no caller to return them to.
+func (e *Engine) runTimers(l *lua.LState) {
+	for {
+		timer, ok := e.timers.due()
+		if !ok {
+			return
+		}
+
+		err := e.withLimits(l, func() error {
+			return l.CallByParam(
+				lua.P{
+					Fn:      timer.fn,
+					NRet:    0,
+					Protect: true,
+				},
+			)
+		})
+
+		e.countOtherCallback("timer", err, "error calling timer callback", "timer", timer.id)
+	}
+}
+
+func (e *Engine) timerLoader(l *lua.LState) int {
+	module := l.SetFuncs(l.NewTable(), map[string]lua.LGFunction{
+		"after":  e.timerAfter,
+		"every":  e.timerEvery,
+		"cancel": e.timerCancel,
+	})
+	l.Push(module)
+	return 1
+}
+
+func checkSeconds(l *lua.LState, n int) time.Duration {
+	return time.Duration(float64(l.CheckNumber(n)) * float64(time.Second))
+}
+
+func (e *Engine) timerAfter(l *lua.LState) int {
+	d := checkSeconds(l, 1)
+	fn := l.CheckFunction(2)
+
+	l.Push(lua.LNumber(e.timers.add(d, 0, fn)))
+	return 1
+}
+
+func (e *Engine) timerEvery(l *lua.LState) int {
+	d := checkSeconds(l, 1)
+	fn := l.CheckFunction(2)
+
+	if d <= 0 {
+		l.ArgError(1, "interval must be greater than 0")
+		return 0
+	}
+
+	l.Push(lua.LNumber(e.timers.add(d, d, fn)))
+	return 1
+}
+
+func (e *Engine) timerCancel(l *lua.LState) int {
+	id := l.CheckInt(1)
+
+	l.Push(lua.LBool(e.timers.cancel(id)))
+	return 1
+}
@@ -1,6 +1,13 @@
 package lua
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/sector-f/failoverd/internal/ping"
 	lua "github.com/yuin/gopher-lua"
 )
@@ -24,24 +31,32 @@ func registerGlobalProbeStatsType(l *lua.LState) {
 	methods := map[string]lua.LGFunction{
 		"lowest_loss": globalProbeStatsLowestLoss,
 		"get":         globalProbeStatsGet,
+		"timestamp":   globalProbeStatsTimestamp,
+		"all":         globalProbeStatsAll,
+		"sorted_by":   globalProbeStatsSortedBy,
+		"filter":      globalProbeStatsFilter,
+		"healthy":     globalProbeStatsHealthy,
+		"best":        globalProbeStatsBest,
+		"pairs":       globalProbeStatsPairs,
 	}
 
 	l.SetField(mt, "__index", l.SetFuncs(l.NewTable(), methods))
+	l.SetField(mt, "__len", l.NewFunction(globalProbeStatsLen))
 }
 
-func checkGlobalProbeStats(l *lua.LState) map[string]ping.ProbeStats {
+func checkGlobalProbeStats(l *lua.LState) ping.Snapshot {
 	ud := l.CheckUserData(1)
-	if v, ok := ud.Value.(map[string]ping.ProbeStats); ok {
+	if v, ok := ud.Value.(ping.Snapshot); ok {
 		return v
 	}
 	l.ArgError(1, "global_probe_stats expected")
-	return nil
+	return ping.Snapshot{}
 }
 
 func globalProbeStatsGet(l *lua.LState) int {
 	gps := checkGlobalProbeStats(l)
 	dst := l.CheckString(2)
-	stats, ok := gps[dst]
+	stats, ok := gps.Get(dst)
 	if !ok {
 		l.ArgError(2, "destination not found")
 		return 0
@@ -57,40 +72,275 @@ func globalProbeStatsGet(l *lua.LState) int {
 
 func globalProbeStatsLowestLoss(l *lua.LState) int {
 	gps := checkGlobalProbeStats(l)
+	lowestProbeStats, _ := gps.LowestLoss()
+
+	l.Push(&lua.LUserData{
+		Value:     &lowestProbeStats,
+		Metatable: l.GetTypeMetatable(luaProbeStatsTypeName),
+	})
+
+	return 1
+}
+
+func globalProbeStatsTimestamp(l *lua.LState) int {
+	gps := checkGlobalProbeStats(l)
+	l.Push(timeToLua(gps.Timestamp))
+	return 1
+}
+
+func globalProbeStatsLen(l *lua.LState) int {
+	gps := checkGlobalProbeStats(l)
+	l.Push(lua.LNumber(gps.Len()))
+	return 1
+}
+
+// globalProbeStatsPairs returns an iterator over destination addresses and their probe_stats, in sorted
+// order, for use as `for dst, ps in gps:pairs() do`. gopher-lua's pairs does not support __pairs.
+func globalProbeStatsPairs(l *lua.LState) int {
+	stats := checkGlobalProbeStats(l).Sorted()
+
+	i := 0
+	next := func(l *lua.LState) int {
+		if i >= len(stats) {
+			l.Push(lua.LNil)
+			return 1
+		}
+
+		ps := stats[i]
+		i++
+
+		l.Push(lua.LString(ps.Dst))
+		l.Push(newProbeStatsUserData(l, ps))
+		return 2
+	}
+
+	l.Push(l.NewFunction(next))
+	l.Push(l.Get(1))
+	l.Push(lua.LNil)
+	return 3
+}
+
+func globalProbeStatsAll(l *lua.LState) int {
+	gps := checkGlobalProbeStats(l)
+	l.Push(probeStatsList(l, gps.Sorted()))
+	return 1
+}
+
+func globalProbeStatsSortedBy(l *lua.LState) int {
+	gps := checkGlobalProbeStats(l)
+	field := l.CheckString(2)
+	window := l.OptString(3, "")
+
+	var score func(ws ping.WindowStats) float64
+	switch field {
+	case "loss":
+		score = func(ws ping.WindowStats) float64 { return ws.Loss }
+	case "rtt":
+		score = func(ws ping.WindowStats) float64 { return rttScore(ws, ws.RTT) }
+	case "jitter":
+		score = func(ws ping.WindowStats) float64 { return rttScore(ws, ws.Jitter) }
+	default:
+		l.ArgError(2, `must be one of "loss", "rtt" or "jitter"`)
+		return 0
+	}
+
+	stats := gps.Sorted()
+	scores := make(map[string]float64, len(stats))
+	for _, ps := range stats {
+		ws, ok := ps.Window(window)
+		if !ok {
+			l.ArgError(3, fmt.Sprintf("window `%s` does not exist for %s", window, ps.Dst))
+			return 0
+		}
+		scores[ps.Dst] = score(ws)
+	}
+
+	sort.SliceStable(stats, func(i, j int) bool {
+		return betterScore(stats[i], scores[stats[i].Dst], stats[j], scores[stats[j].Dst])
+	})
+
+	l.Push(probeStatsList(l, stats))
+	return 1
+}
+
+func globalProbeStatsFilter(l *lua.LState) int {
+	gps := checkGlobalProbeStats(l)
+	fn := l.CheckFunction(2)
+
+	filtered := []ping.ProbeStats{}
+	for _, ps := range gps.Sorted() {
+		l.Push(fn)
+		l.Push(newProbeStatsUserData(l, ps))
+		l.Call(1, 1)
+
+		keep := lua.LVAsBool(l.Get(-1))
+		l.Pop(1)
+
+		if keep {
+			filtered = append(filtered, ps)
+		}
+	}
+
+	l.Push(probeStatsList(l, filtered))
+	return 1
+}
+
+func globalProbeStatsHealthy(l *lua.LState) int {
+	gps := checkGlobalProbeStats(l)
+
+	isHealthy := func(ps ping.ProbeStats) bool { return ps.Loss < 100 }
+	if l.GetTop() >= 2 {
+		maxLoss := float64(l.CheckNumber(2))
+		isHealthy = func(ps ping.ProbeStats) bool { return ps.Loss <= maxLoss }
+	}
+
+	healthy := []ping.ProbeStats{}
+	for _, ps := range gps.Sorted() {
+		if isHealthy(ps) {
+			healthy = append(healthy, ps)
+		}
+	}
+
+	l.Push(probeStatsList(l, healthy))
+	return 1
+}
+
+// globalProbeStatsBest returns the probe_stats with the lowest score, as computed by the
+// (optional) score function. Probes for which the function returns nil are skipped.
+func globalProbeStatsBest(l *lua.LState) int {
+	gps := checkGlobalProbeStats(l)
+	fn := l.OptFunction(2, nil)
 
 	var (
-		lowestProbeStats ping.ProbeStats
-		first            bool = true
+		best      ping.ProbeStats
+		bestScore float64
+		found     bool
 	)
 
-	for _, stats := range gps {
-		if first {
-			lowestProbeStats = stats
-			first = false
-			continue
+	for _, ps := range gps.Sorted() {
+		score := ps.Loss
+
+		if fn != nil {
+			l.Push(fn)
+			l.Push(newProbeStatsUserData(l, ps))
+			l.Call(1, 1)
+
+			ret := l.Get(-1)
+			l.Pop(1)
+
+			switch ret := ret.(type) {
+			case lua.LNumber:
+				score = float64(ret)
+			case *lua.LNilType:
+				continue
+			default:
+				l.RaiseError("score function must return a number or nil, not a %s", ret.Type())
+				return 0
+			}
 		}
 
-		if stats.Loss < lowestProbeStats.Loss {
-			lowestProbeStats = stats
+		if !found || betterScore(ps, score, best, bestScore) {
+			best = ps
+			bestScore = score
+			found = true
 		}
 	}
 
-	l.Push(&lua.LUserData{
-		Value:     &lowestProbeStats,
-		Metatable: l.GetTypeMetatable(luaProbeStatsTypeName),
-	})
+	if !found {
+		l.Push(lua.LNil)
+		return 1
+	}
 
+	l.Push(newProbeStatsUserData(l, best))
 	return 1
 }
 
+// betterScore reports whether probe a (with score aScore) should be preferred over probe b.
+// Lower scores are better; ties are broken by priority and then by destination address.
+func betterScore(a ping.ProbeStats, aScore float64, b ping.ProbeStats, bScore float64) bool {
+	if aScore != bScore {
+		return aScore < bScore
+	}
+
+	if a.Priority != b.Priority {
+		return a.Priority < b.Priority
+	}
+
+	return ping.CompareDst(a.Dst, b.Dst) < 0
+}
+
+// rttScore returns d in milliseconds, or +Inf if the window has no round-trip time data
+func rttScore(ws ping.WindowStats, d time.Duration) float64 {
+	if !ws.HasRTT {
+		return math.Inf(1)
+	}
+
+	return durationToMillis(d)
+}
+
+func durationToMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// timeToLua returns t in seconds since the Unix epoch, or nil if t is the zero time
+func timeToLua(t time.Time) lua.LValue {
+	if t.IsZero() {
+		return lua.LNil
+	}
+
+	return lua.LNumber(float64(t.UnixNano()) / float64(time.Second))
+}
+
+func newProbeStatsUserData(l *lua.LState, ps ping.ProbeStats) *lua.LUserData {
+	return &lua.LUserData{
+		Value:     &ps,
+		Metatable: l.GetTypeMetatable(luaProbeStatsTypeName),
+	}
+}
+
+func probeStatsList(l *lua.LState, stats []ping.ProbeStats) *lua.LTable {
+	table := l.CreateTable(len(stats), 0)
+	for _, ps := range stats {
+		table.Append(newProbeStatsUserData(l, ps))
+	}
+
+	return table
+}
+
 func registerProbeStatsType(l *lua.LState) {
 	mt := l.NewTypeMetatable(luaProbeStatsTypeName)
 	l.SetGlobal(luaProbeStatsTypeName, mt)
 
 	methods := map[string]lua.LGFunction{
-		"src":  probeStatsGetSrc,
-		"dst":  probeStatsGetDst,
-		"loss": probeStatsGetLoss,
+		"src":      probeStatsGetSrc,
+		"dst":      probeStatsGetDst,
+		"priority": probeStatsGetPriority,
+		"loss":     probeStatsGetLoss,
+		"windows":  probeStatsGetWindows,
+
+		"rtt":     probeStatsRTTGetter(func(ws ping.WindowStats) time.Duration { return ws.RTT }),
+		"jitter":  probeStatsRTTGetter(func(ws ping.WindowStats) time.Duration { return ws.Jitter }),
+		"rtt_min": probeStatsRTTGetter(func(ws ping.WindowStats) time.Duration { return ws.RTTMin }),
+		"rtt_max": probeStatsRTTGetter(func(ws ping.WindowStats) time.Duration { return ws.RTTMax }),
+		"rtt_p50": probeStatsRTTGetter(func(ws ping.WindowStats) time.Duration { return ws.RTTP50 }),
+		"rtt_p95": probeStatsRTTGetter(func(ws ping.WindowStats) time.Duration { return ws.RTTP95 }),
+		"rtt_p99": probeStatsRTTGetter(func(ws ping.WindowStats) time.Duration { return ws.RTTP99 }),
+
+		"loss_ewma": probeStatsGetLossEWMA,
+		"rtt_ewma":  probeStatsGetRTTEWMA,
+
+		"sent":            probeStatsGetSent,
+		"received":        probeStatsGetReceived,
+		"window_sent":     probeStatsGetWindowSent,
+		"window_received": probeStatsGetWindowReceived,
+
+		"started":      probeStatsGetStarted,
+		"age":          probeStatsGetAge,
+		"last_success": probeStatsGetLastSuccess,
+		"last_failure": probeStatsGetLastFailure,
+
+		"success_streak": probeStatsGetSuccessStreak,
+		"failure_streak": probeStatsGetFailureStreak,
 	}
 
 	l.SetField(mt, "__index", l.SetFuncs(l.NewTable(), methods))
@@ -117,32 +367,183 @@ func probeStatsGetDst(l *lua.LState) int {
 	return 1
 }
 
+func probeStatsGetPriority(l *lua.LState) int {
+	p := checkProbeStats(l)
+	l.Push(lua.LNumber(p.Priority))
+	return 1
+}
+
+// checkWindow returns the statistics of the window named by the (optional) argument at index n
+func checkWindow(l *lua.LState, p *ping.ProbeStats, n int) ping.WindowStats {
+	name := l.OptString(n, "")
+	ws, ok := p.Window(name)
+	if !ok {
+		l.ArgError(n, fmt.Sprintf("window `%s` does not exist", name))
+	}
+
+	return ws
+}
+
+func probeStatsGetWindows(l *lua.LState) int {
+	p := checkProbeStats(l)
+
+	names := make([]string, 0, len(p.Windows))
+	for name := range p.Windows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	table := l.CreateTable(len(names), 0)
+	for _, name := range names {
+		table.Append(lua.LString(name))
+	}
+
+	l.Push(table)
+	return 1
+}
+
 func probeStatsGetLoss(l *lua.LState) int {
 	p := checkProbeStats(l)
-	l.Push(lua.LNumber(p.Loss))
+	ws := checkWindow(l, p, 2)
+	l.Push(lua.LNumber(ws.Loss))
+	return 1
+}
+
+// probeStatsRTTGetter returns a method that pushes a round-trip time statistic of a window
+// in milliseconds, or nil if the window has no round-trip time data
+func probeStatsRTTGetter(get func(ws ping.WindowStats) time.Duration) lua.LGFunction {
+	return func(l *lua.LState) int {
+		p := checkProbeStats(l)
+		ws := checkWindow(l, p, 2)
+		if !ws.HasRTT {
+			l.Push(lua.LNil)
+			return 1
+		}
+
+		l.Push(lua.LNumber(durationToMillis(get(ws))))
+		return 1
+	}
+}
+
+func probeStatsGetLossEWMA(l *lua.LState) int {
+	p := checkProbeStats(l)
+	l.Push(lua.LNumber(p.LossEWMA))
+	return 1
+}
+
+func probeStatsGetRTTEWMA(l *lua.LState) int {
+	p := checkProbeStats(l)
+	if p.Received == 0 {
+		l.Push(lua.LNil)
+		return 1
+	}
+
+	l.Push(lua.LNumber(durationToMillis(p.RTTEWMA)))
+	return 1
+}
+
+func probeStatsGetSent(l *lua.LState) int {
+	p := checkProbeStats(l)
+	l.Push(lua.LNumber(p.Sent))
+	return 1
+}
+
+func probeStatsGetReceived(l *lua.LState) int {
+	p := checkProbeStats(l)
+	l.Push(lua.LNumber(p.Received))
+	return 1
+}
+
+func probeStatsGetWindowSent(l *lua.LState) int {
+	p := checkProbeStats(l)
+	ws := checkWindow(l, p, 2)
+	l.Push(lua.LNumber(ws.Sent))
+	return 1
+}
+
+func probeStatsGetWindowReceived(l *lua.LState) int {
+	p := checkProbeStats(l)
+	ws := checkWindow(l, p, 2)
+	l.Push(lua.LNumber(ws.Received))
+	return 1
+}
+
+func probeStatsGetStarted(l *lua.LState) int {
+	p := checkProbeStats(l)
+	l.Push(timeToLua(p.Started))
+	return 1
+}
+
+func probeStatsGetAge(l *lua.LState) int {
+	p := checkProbeStats(l)
+	l.Push(lua.LNumber(p.Age().Seconds()))
+	return 1
+}
+
+func probeStatsGetLastSuccess(l *lua.LState) int {
+	p := checkProbeStats(l)
+	l.Push(timeToLua(p.LastSuccess))
+	return 1
+}
+
+func probeStatsGetLastFailure(l *lua.LState) int {
+	p := checkProbeStats(l)
+	l.Push(timeToLua(p.LastFailure))
+	return 1
+}
+
+func probeStatsGetSuccessStreak(l *lua.LState) int {
+	p := checkProbeStats(l)
+	l.Push(lua.LNumber(p.SuccessStreak))
+	return 1
+}
+
+func probeStatsGetFailureStreak(l *lua.LState) int {
+	p := checkProbeStats(l)
+	l.Push(lua.LNumber(p.FailureStreak))
 	return 1
 }
 
 func registerProbeType(l *lua.LState) {
 	mt := l.NewTypeMetatable(luaProbeTypeName)
 	l.SetGlobal(luaProbeTypeName, mt)
-	l.SetField(mt, "new", l.NewFunction(newProbe))
 	// l.SetField(mt, "__index", l.SetFuncs(l.NewTable(), nil))
 }
 
+// luaProbe is the value of a probe userdata
+type luaProbe struct {
+	ping.Probe
+	where string // Position in the script at which the probe was created, e.g. "config.lua:12:"
+}
+
 func checkProbe(l *lua.LState) ping.Probe {
 	ud := l.CheckUserData(1)
-	if v, ok := ud.Value.(ping.Probe); ok {
-		return v
+	if v, ok := ud.Value.(luaProbe); ok {
+		return v.Probe
 	}
 	l.ArgError(1, "probe expected")
 	return ping.Probe{}
 }
 
-func newProbe(l *lua.LState) int {
+// newProbe implements probe.new. While the script is being loaded, problems with the options
+// are collected and reported along with the other configuration errors; afterwards, they are raised.
+func (e *Engine) newProbe(l *lua.LState) int {
 	p := ping.Probe{}
 
-	switch l.GetTop() {
+	// An options table may be passed as the last argument
+	var optionsErr error
+	top := l.GetTop()
+	if opts, ok := l.Get(top).(*lua.LTable); ok && top > 1 {
+		optionsErr = probeOptionsFromLua(&p, opts)
+		if optionsErr != nil && !e.loading {
+			l.ArgError(top, optionsErr.Error())
+			return 0
+		}
+
+		top--
+	}
+
+	switch top {
 	case 1:
 		p.Dst = l.CheckString(1)
 	case 2:
@@ -153,18 +554,67 @@ func newProbe(l *lua.LState) int {
 		return 0
 	}
 
+	if optionsErr != nil {
+		e.probeErrs = append(e.probeErrs, fmt.Errorf("%s probe %s: %w", l.Where(1), p.Dst, optionsErr))
+	}
+
 	l.Push(&lua.LUserData{
-		Value:     p,
+		Value:     luaProbe{Probe: p, where: l.Where(1)},
 		Metatable: l.GetTypeMetatable(luaProbeTypeName),
 	})
 
 	return 1
 }
 
+// probeOptionsFromLua applies the options table passed to probe.new, rejecting unknown options.
+// Every problem is reported, in a stable order.
+func probeOptionsFromLua(p *ping.Probe, opts *lua.LTable) error {
+	errs := []error{}
+
+	opts.ForEach(func(key lua.LValue, val lua.LValue) {
+		switch key.String() {
+		case "priority":
+			priority, ok := val.(lua.LNumber)
+			if !ok {
+				errs = append(errs, fmt.Errorf("`priority` must be a number, not a %s", val.Type()))
+				return
+			}
+			p.Priority = int(priority)
+		case "windows":
+			windows, ok := val.(*lua.LTable)
+			if !ok {
+				errs = append(errs, fmt.Errorf("`windows` must be a table, not a %s", val.Type()))
+				return
+			}
+
+			w, windowErrs := windowsFromLua(windows)
+			for _, err := range windowErrs {
+				errs = append(errs, fmt.Errorf("`windows`: %w", err))
+			}
+			p.Windows = w
+		default:
+			errs = append(errs, fmt.Errorf("unknown option `%s`", key))
+		}
+	})
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	sort.Strings(msgs)
+
+	return errors.New(strings.Join(msgs, "; "))
+}
+
 func (e *Engine) registerProbePingerCommands(l *lua.LState) {
 	mt := l.GetTypeMetatable(luaProbeTypeName)
 
 	methods := map[string]lua.LGFunction{
+		"new":   e.newProbe,
 		"start": e.startProbe,
 		"stop":  e.stopProbe,
 	}
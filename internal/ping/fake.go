@@ -0,0 +1,81 @@
+package ping
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// FakeResponse is a scripted response to a ping sent by a FakeProber.
+type FakeResponse struct {
+	Lost bool
+	RTT  time.Duration
+}
+
+// Reply returns a FakeResponse that is received after the given round-trip time.
+func Reply(rtt time.Duration) FakeResponse {
+	return FakeResponse{RTT: rtt}
+}
+
+// Lost returns a FakeResponse that is never received.
+func Lost() FakeResponse {
+	return FakeResponse{Lost: true}
+}
+
+// FakeProber is a Prober that returns scripted responses without sending any packets,
+// for testing Pingers (and the scripts that use their statistics).
+//
+// Responses are returned immediately; the round-trip time is only reported, not waited for.
+type FakeProber struct {
+	responses map[string][]FakeResponse // Maps destination addresses to the remaining responses
+	pings     map[string]int            // Maps destination addresses to the number of pings sent
+
+	mu sync.Mutex
+}
+
+func NewFakeProber() *FakeProber {
+	return &FakeProber{
+		responses: make(map[string][]FakeResponse),
+		pings:     make(map[string]int),
+	}
+}
+
+// Script appends responses to the sequence returned for pings to dst. Once the sequence
+// is exhausted its last response is repeated; pings to destinations with no script are lost.
+func (f *FakeProber) Script(dst string, responses ...FakeResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.responses[dst] = append(f.responses[dst], responses...)
+}
+
+// Pings returns the number of pings that have been sent to dst.
+func (f *FakeProber) Pings(dst string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.pings[dst]
+}
+
+func (f *FakeProber) Ping(ctx context.Context, probe Probe) (time.Duration, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.pings[probe.Dst]++
+
+	responses := f.responses[probe.Dst]
+	if len(responses) == 0 {
+		return 0, ErrNoResponse
+	}
+
+	response := responses[0]
+	if len(responses) > 1 {
+		f.responses[probe.Dst] = responses[1:]
+	}
+
+	if response.Lost {
+		return 0, ErrNoResponse
+	}
+
+	return response.RTT, nil
+}
@@ -0,0 +1,111 @@
+package ping
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// MarshalJSON encodes the statistics as an object whose fields have the same names as the
+// Lua probe_stats methods. Times are in seconds since the Unix epoch and round-trip times
+// are in milliseconds; both are null if there is no data.
+func (ps ProbeStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(probeStatsJSON(ps))
+}
+
+// MarshalJSON encodes the snapshot as an object with its timestamp and an array of every
+// probe's statistics, sorted by destination address.
+func (s Snapshot) MarshalJSON() ([]byte, error) {
+	return json.Marshal(globalProbeStatsJSON(s))
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// timeToJSON returns t in seconds since the Unix epoch, or nil if t is the zero time
+func timeToJSON(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// windowStatsJSON converts window statistics to an object with the same names as the
+// Lua probe_stats methods. Round-trip times are in milliseconds.
+func windowStatsJSON(ws WindowStats) map[string]interface{} {
+	m := map[string]interface{}{
+		"loss":     ws.Loss,
+		"sent":     ws.Sent,
+		"received": ws.Received,
+	}
+
+	rtts := map[string]time.Duration{
+		"rtt":     ws.RTT,
+		"jitter":  ws.Jitter,
+		"rtt_min": ws.RTTMin,
+		"rtt_max": ws.RTTMax,
+		"rtt_p50": ws.RTTP50,
+		"rtt_p95": ws.RTTP95,
+		"rtt_p99": ws.RTTP99,
+	}
+
+	for name, d := range rtts {
+		if ws.HasRTT {
+			m[name] = millis(d)
+		} else {
+			m[name] = nil
+		}
+	}
+
+	return m
+}
+
+func probeStatsJSON(ps ProbeStats) map[string]interface{} {
+	// The statistics for the default window are at the top level, as they are in Lua
+	ws, _ := ps.Window("")
+	m := windowStatsJSON(ws)
+	delete(m, "sent")
+	delete(m, "received")
+
+	m["src"] = ps.Src
+	m["dst"] = ps.Dst
+	m["priority"] = ps.Priority
+
+	m["loss_ewma"] = ps.LossEWMA
+	m["rtt_ewma"] = nil
+	if ps.Received > 0 {
+		m["rtt_ewma"] = millis(ps.RTTEWMA)
+	}
+
+	m["sent"] = ps.Sent
+	m["received"] = ps.Received
+	m["window_sent"] = ps.WindowSent
+	m["window_received"] = ps.WindowReceived
+
+	m["started"] = timeToJSON(ps.Started)
+	m["last_success"] = timeToJSON(ps.LastSuccess)
+	m["last_failure"] = timeToJSON(ps.LastFailure)
+	m["success_streak"] = ps.SuccessStreak
+	m["failure_streak"] = ps.FailureStreak
+
+	windows := make(map[string]interface{}, len(ps.Windows))
+	for name, ws := range ps.Windows {
+		windows[name] = windowStatsJSON(ws)
+	}
+	m["windows"] = windows
+
+	return m
+}
+
+func globalProbeStatsJSON(gps Snapshot) map[string]interface{} {
+	probes := []interface{}{}
+	for _, ps := range gps.Sorted() {
+		probes = append(probes, probeStatsJSON(ps))
+	}
+
+	return map[string]interface{}{
+		"timestamp": timeToJSON(gps.Timestamp),
+		"probes":    probes,
+	}
+}
@@ -1,19 +1,36 @@
 package ping
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
 	"sync"
 	"time"
 
-	rb "github.com/sector-f/failoverd/internal/ringbuffer"
+	"github.com/sector-f/failoverd/internal/clock"
 )
 
 type Pinger struct {
+	// OnRecv is called from Run whenever a probe result is received.
+	// It is called without the Pinger's lock held, so it may call StartProbe and StopProbe.
 	OnRecv func(ps ProbeStats)
 
+	// OnResult is called from Run with every raw probe result, before its statistics are updated.
+	OnResult func(res Result)
+
+	// OnProbeStarted and OnProbeStopped are called whenever a probe is started or stopped,
+	// including the probes started by Run. They are called without the Pinger's lock held.
+	OnProbeStarted func(probe Probe)
+	OnProbeStopped func(dst string)
+
 	pingFreqency time.Duration
 	privileged   bool
+	prober       Prober
 	numSeconds   uint
+	windows      map[string]uint
+	ewmaAlpha    float64
+	clock        clock.Clock
+	logger       *slog.Logger
 
 	closeChan chan struct{}
 
@@ -23,9 +40,14 @@ type Pinger struct {
 	stoppers map[string]chan struct{} // Maps destinations to channels which are used to stop running pings
 	stopWG   sync.WaitGroup
 
-	statTracker map[string]*rb.RingBuffer // Maps destination addresses to ring buffers
-	statCh      chan ProbeStats
+	statTracker map[string]*tracker // Maps destination addresses to trackers
+	statCh      chan Result
+	lastRecv    time.Time // When the most recent result was processed by Run
 	mu          sync.Mutex
+
+	replay bool // Whether results are fed in by Replay rather than sent by probes
+
+	restored map[string]ProbeState // Saved statistics not yet restored, mapped by destination
 }
 
 func NewPinger(probes []Probe, options ...Option) (*Pinger, error) {
@@ -51,15 +73,15 @@ func NewPinger(probes []Probe, options ...Option) (*Pinger, error) {
 
 		globalProbeStats: make(map[string]ProbeStats),
 
-		statTracker: make(map[string]*rb.RingBuffer),
-		statCh:      make(chan ProbeStats),
+		statTracker: make(map[string]*tracker),
+		statCh:      make(chan Result),
 		mu:          sync.Mutex{},
 	}
 
-	return p, nil
-}
+	for _, option := range options {
+		option(p)
+	}
 
-func (p *Pinger) Run() {
 	if p.pingFreqency <= 0 {
 		p.pingFreqency = 1 * time.Second
 	}
@@ -68,36 +90,114 @@ func (p *Pinger) Run() {
 		p.numSeconds = 10
 	}
 
-	for i := range p.probes {
-		p.statTracker[p.probes[i].Dst] = rb.New(p.numSeconds)
-		go p.probes[i].run(p.pingFreqency, p.privileged, p.statCh, p.stoppers[p.probes[i].Dst], &p.stopWG)
+	if p.ewmaAlpha <= 0 || p.ewmaAlpha > 1 {
+		p.ewmaAlpha = DefaultEWMAAlpha
 	}
 
-	for {
-		select {
-		case msg := <-p.statCh:
-			p.mu.Lock()
+	if p.clock == nil {
+		p.clock = clock.Real()
+	}
 
-			statTracker := p.statTracker[msg.Dst]
-			statTracker.Insert(msg.Loss)
+	if p.prober == nil {
+		p.prober = ICMPProber{Privileged: p.privileged}
+	}
 
-			stats := ProbeStats{
-				Src:  msg.Src,
-				Dst:  msg.Dst,
-				Loss: statTracker.Average(),
-			}
+	if p.logger == nil {
+		p.logger = slog.Default()
+	}
 
-			p.globalProbeStats[msg.Dst] = stats
+	return p, nil
+}
 
-			p.mu.Unlock()
+// NewReplayPinger returns a Pinger that does not send any pings. Instead, previously recorded
+// results are fed into it using Replay. The probes are not validated, since they may refer to
+// interfaces that only exist on the machine where the results were recorded.
+//
+// StartProbe and StopProbe only add and remove a probe's statistics. Run must not be called.
+func NewReplayPinger(probes []Probe, options ...Option) *Pinger {
+	p, _ := NewPinger(nil, options...)
+	p.replay = true
+
+	for _, probe := range probes {
+		p.addProbe(probe)
+	}
 
-			if p.OnRecv != nil {
-				p.OnRecv(stats)
-			}
+	return p
+}
+
+// Replay processes a recorded result as if it had just been received, calling OnRecv.
+// A probe is created for the result's destination if one does not already exist.
+func (p *Pinger) Replay(res Result) {
+	p.mu.Lock()
+	if _, ok := p.statTracker[res.Dst]; !ok {
+		p.addProbe(Probe{Src: res.Src, Dst: res.Dst})
+	}
+	p.mu.Unlock()
+
+	p.handle(res)
+}
+
+// handle updates the statistics for a result and calls OnRecv
+func (p *Pinger) handle(res Result) {
+	if p.OnResult != nil {
+		p.OnResult(res)
+	}
+
+	// Lost pings are expected; anything else (e.g. a network that is unreachable) is worth knowing about
+	if res.Err != nil && !errors.Is(res.Err, ErrNoResponse) {
+		p.logger.Debug("ping failed", "dst", res.Dst, "src", res.Src, "err", res.Err)
+	}
+
+	p.mu.Lock()
+
+	statTracker, ok := p.statTracker[res.Dst]
+	if !ok {
+		// The probe was stopped while this result was in flight
+		p.mu.Unlock()
+		return
+	}
+	statTracker.insert(res)
+	stats := statTracker.stats(res.Src)
+
+	p.globalProbeStats[res.Dst] = stats
+	p.lastRecv = p.clock.Now()
+
+	p.mu.Unlock()
+
+	if p.OnRecv != nil {
+		p.OnRecv(stats)
+	}
+}
+
+func (p *Pinger) Run() {
+	p.mu.Lock()
+	probes := make([]Probe, len(p.probes))
+	copy(probes, p.probes)
+
+	for i := range probes {
+		p.startTracker(probes[i])
+		p.logger.Info("probe started", "dst", probes[i].Dst, "src", probes[i].Src)
+		p.stopWG.Add(1)
+		go probes[i].run(p.prober, p.clock, p.pingFreqency, p.statCh, p.stoppers[probes[i].Dst], &p.stopWG)
+	}
+	p.mu.Unlock()
+
+	if p.OnProbeStarted != nil {
+		for _, probe := range probes {
+			p.OnProbeStarted(probe)
+		}
+	}
+
+	for {
+		select {
+		case msg := <-p.statCh:
+			p.handle(msg)
 		case <-p.closeChan:
+			p.mu.Lock()
 			for _, ch := range p.stoppers {
 				ch <- struct{}{}
 			}
+			p.mu.Unlock()
 
 			go func() {
 				for i := 0; i < len(p.probes); i++ {
@@ -110,6 +210,15 @@ func (p *Pinger) Run() {
 	}
 }
 
+func (p *Pinger) trackerOptions() trackerOptions {
+	return trackerOptions{
+		seconds:   p.numSeconds,
+		windows:   p.windows,
+		ewmaAlpha: p.ewmaAlpha,
+		clock:     p.clock,
+	}
+}
+
 func (p *Pinger) GetProbeStats(dst string) ProbeStats {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -117,11 +226,21 @@ func (p *Pinger) GetProbeStats(dst string) ProbeStats {
 	return p.globalProbeStats[dst]
 }
 
-func (p *Pinger) Stats() map[string]ProbeStats {
+// Stats returns a snapshot of the current statistics of every probe.
+func (p *Pinger) Stats() Snapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return NewSnapshot(p.clock.Now(), p.globalProbeStats)
+}
+
+// LastRecv returns the time at which Run last processed a probe result.
+// It is the zero time if no results have been processed yet.
+func (p *Pinger) LastRecv() time.Time {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	return p.globalProbeStats
+	return p.lastRecv
 }
 
 func (p *Pinger) Stop() {
@@ -131,24 +250,90 @@ func (p *Pinger) Stop() {
 }
 
 func (p *Pinger) StartProbe(probe Probe) error {
+	started, err := p.startProbe(probe)
+	if err != nil {
+		return err
+	}
+
+	if p.OnProbeStarted != nil {
+		p.OnProbeStarted(started)
+	}
+
+	return nil
+}
+
+func (p *Pinger) startProbe(probe Probe) (Probe, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	if p.replay {
+		p.addProbe(probe)
+		return probe, nil
+	}
+
 	validated, err := newProbe(probe)
 	if err != nil {
-		return err
+		return Probe{}, err
 	}
 
+	stopper := p.addProbe(validated)
+	p.logger.Info("probe started", "dst", validated.Dst, "src", validated.Src)
+	p.stopWG.Add(1)
+	go validated.run(p.prober, p.clock, p.pingFreqency, p.statCh, stopper, &p.stopWG)
+
+	return validated, nil
+}
+
+// addProbe starts tracking statistics for a probe, returning the channel used to stop it.
+// p.mu must be held if the Pinger is running.
+func (p *Pinger) addProbe(probe Probe) chan struct{} {
 	stopper := make(chan struct{}, 1)
-	p.probes = append(p.probes, validated)
-	p.stoppers[validated.Dst] = stopper
-	p.statTracker[validated.Dst] = rb.New(p.numSeconds)
-	go validated.run(p.pingFreqency, p.privileged, p.statCh, stopper, &p.stopWG)
+	p.probes = append(p.probes, probe)
+	p.stoppers[probe.Dst] = stopper
+	p.startTracker(probe)
 
-	return nil
+	return stopper
+}
+
+// startTracker starts tracking statistics for a probe, restoring any saved statistics for its
+// destination. p.mu must be held if the Pinger is running.
+func (p *Pinger) startTracker(probe Probe) {
+	t := newTracker(probe, p.trackerOptions(), p.clock.Now())
+	p.statTracker[probe.Dst] = t
+
+	if state, ok := p.restored[probe.Dst]; ok {
+		// Saved statistics only apply to the first run of a probe
+		delete(p.restored, probe.Dst)
+
+		err := t.restore(state)
+		if err != nil {
+			p.logger.Warn("could not restore some probe statistics; they start out empty", "dst", probe.Dst, "err", err)
+		} else {
+			p.logger.Info("restored probe statistics", "dst", probe.Dst)
+		}
+
+		// Every result in the default window may have expired while failoverd was stopped, in which
+		// case there are no statistics to publish until the next result, as for a new probe
+		if t.window.loss.Count() > 0 {
+			p.globalProbeStats[probe.Dst] = t.stats(probe.Src)
+		}
+	}
 }
 
 func (p *Pinger) StopProbe(dst string) error {
+	err := p.stopProbe(dst)
+	if err != nil {
+		return err
+	}
+
+	if p.OnProbeStopped != nil {
+		p.OnProbeStopped(dst)
+	}
+
+	return nil
+}
+
+func (p *Pinger) stopProbe(dst string) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -170,6 +355,8 @@ func (p *Pinger) StopProbe(dst string) error {
 	delete(p.globalProbeStats, dst)
 	delete(p.statTracker, dst)
 
+	p.logger.Info("probe stopped", "dst", dst)
+
 	return nil
 }
 
@@ -181,6 +368,14 @@ func WithPingFrequency(t time.Duration) Option {
 	}
 }
 
+// WithProber sets the Prober used to send pings. The default is an ICMPProber,
+// whose Privileged field is set by WithPrivileged.
+func WithProber(prober Prober) Option {
+	return func(p *Pinger) {
+		p.prober = prober
+	}
+}
+
 func WithPrivileged(privileged bool) Option {
 	return func(p *Pinger) {
 		p.privileged = privileged
@@ -192,3 +387,34 @@ func WithNumSeconds(n uint) Option {
 		p.numSeconds = n
 	}
 }
+
+// WithClock sets the clock used for scheduling pings and expiring statistics. The default is clock.Real().
+func WithClock(c clock.Clock) Option {
+	return func(p *Pinger) {
+		p.clock = c
+	}
+}
+
+// WithLogger sets the logger used to report probes starting and stopping. The default is slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(p *Pinger) {
+		p.logger = logger
+	}
+}
+
+// DefaultEWMAAlpha is the weight given to each new result in exponentially weighted moving averages.
+const DefaultEWMAAlpha = 0.1
+
+// WithEWMAAlpha sets the weight (0-1) given to each new result in exponentially weighted moving averages.
+func WithEWMAAlpha(alpha float64) Option {
+	return func(p *Pinger) {
+		p.ewmaAlpha = alpha
+	}
+}
+
+// WithWindows sets additional named windows, in seconds, to track for every probe.
+func WithWindows(windows map[string]uint) Option {
+	return func(p *Pinger) {
+		p.windows = windows
+	}
+}
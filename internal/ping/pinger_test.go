@@ -0,0 +1,335 @@
+package ping
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sector-f/failoverd/internal/clock"
+)
+
+// testPinger runs a Pinger using a FakeProber and a fake clock.
+type testPinger struct {
+	*Pinger
+
+	clock  *clock.Fake
+	prober *FakeProber
+	recv   chan ProbeStats
+}
+
+func newTestPinger(t *testing.T, probes []Probe, options ...Option) *testPinger {
+	t.Helper()
+
+	tp := &testPinger{
+		clock:  clock.NewFake(time.Unix(1000, 0)),
+		prober: NewFakeProber(),
+		recv:   make(chan ProbeStats, 100),
+	}
+
+	options = append(options, WithClock(tp.clock), WithProber(tp.prober))
+	p, err := NewPinger(probes, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.OnRecv = func(ps ProbeStats) {
+		tp.recv <- ps
+	}
+
+	tp.Pinger = p
+	return tp
+}
+
+func (tp *testPinger) start(t *testing.T) {
+	go tp.Run()
+	t.Cleanup(tp.Stop)
+}
+
+// wait waits for one result from each of n probes
+func (tp *testPinger) wait(t *testing.T, n int) map[string]ProbeStats {
+	t.Helper()
+
+	stats := make(map[string]ProbeStats)
+	for i := 0; i < n; i++ {
+		select {
+		case ps := <-tp.recv:
+			stats[ps.Dst] = ps
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for probe results")
+		}
+	}
+
+	return stats
+}
+
+// round waits for one result from each of n probes, then advances the clock to the next round of pings
+func (tp *testPinger) round(t *testing.T, n int) map[string]ProbeStats {
+	t.Helper()
+
+	stats := tp.wait(t, n)
+	tp.clock.Advance(1 * time.Second)
+	return stats
+}
+
+func TestPingerWithFakeProber(t *testing.T) {
+	tp := newTestPinger(t, []Probe{{Dst: "192.168.0.1"}, {Dst: "192.168.0.2"}}, WithNumSeconds(10))
+	tp.prober.Script("192.168.0.1", Reply(10*time.Millisecond), Reply(10*time.Millisecond), Lost(), Reply(30*time.Millisecond))
+	tp.prober.Script("192.168.0.2", Lost())
+	tp.start(t)
+
+	var stats map[string]ProbeStats
+	for i := 0; i < 4; i++ {
+		stats = tp.round(t, 2)
+	}
+
+	a := stats["192.168.0.1"]
+	if a.Loss != 25 || a.RTT != 50*time.Millisecond/3 || a.Sent != 4 {
+		t.Fatalf("Unexpected stats for 192.168.0.1: loss %v, rtt %v, sent %v", a.Loss, a.RTT, a.Sent)
+	}
+
+	b := stats["192.168.0.2"]
+	if b.Loss != 100 || b.HasRTT || b.FailureStreak != 4 {
+		t.Fatalf("Unexpected stats for 192.168.0.2: loss %v, has rtt %v, failure streak %v", b.Loss, b.HasRTT, b.FailureStreak)
+	}
+
+	snapshot := tp.Stats()
+	if snapshot.Len() != 2 {
+		t.Fatalf("Expected 2 probes in snapshot, got %d", snapshot.Len())
+	}
+}
+
+func TestPingerWindowExpiry(t *testing.T) {
+	tp := newTestPinger(t, []Probe{{Dst: "192.168.0.1"}}, WithNumSeconds(2))
+	tp.prober.Script("192.168.0.1", Lost(), Lost(), Reply(10*time.Millisecond))
+	tp.start(t)
+
+	var stats map[string]ProbeStats
+	for i := 0; i < 4; i++ {
+		stats = tp.round(t, 1)
+	}
+
+	// Only the last two pings are within the window
+	ps := stats["192.168.0.1"]
+	if ps.Loss != 0 || ps.WindowSent != 2 {
+		t.Fatalf("Expected no loss over 2 pings, got %v over %v", ps.Loss, ps.WindowSent)
+	}
+}
+
+func TestPingerStopProbe(t *testing.T) {
+	tp := newTestPinger(t, []Probe{{Dst: "192.168.0.1"}, {Dst: "192.168.0.2"}})
+	tp.prober.Script("192.168.0.1", Reply(10*time.Millisecond))
+	tp.prober.Script("192.168.0.2", Reply(10*time.Millisecond))
+
+	var started, stopped []string
+	tp.OnProbeStarted = func(probe Probe) {
+		started = append(started, probe.Dst)
+	}
+	tp.OnProbeStopped = func(dst string) {
+		stopped = append(stopped, dst)
+	}
+
+	tp.start(t)
+
+	tp.wait(t, 2)
+
+	err := tp.StopProbe("192.168.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(started) != 2 || len(stopped) != 1 || stopped[0] != "192.168.0.2" {
+		t.Fatalf("Expected 2 probes to be started and 192.168.0.2 to be stopped, got %v and %v", started, stopped)
+	}
+
+	err = tp.StopProbe("192.168.0.2")
+	if err == nil {
+		t.Fatalf("Expected error when stopping a stopped probe")
+	}
+
+	tp.clock.Advance(1 * time.Second)
+
+	stats := tp.wait(t, 1)
+	if _, ok := stats["192.168.0.1"]; !ok {
+		t.Fatalf("Expected results from 192.168.0.1")
+	}
+
+	if tp.Stats().Len() != 1 {
+		t.Fatalf("Expected 1 probe in snapshot, got %d", tp.Stats().Len())
+	}
+}
+
+func TestReplayPinger(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clk := clock.NewFake(start)
+	p := NewReplayPinger([]Probe{{Dst: "192.168.0.1", Priority: 1}}, WithClock(clk), WithNumSeconds(2))
+
+	var recv []ProbeStats
+	p.OnRecv = func(ps ProbeStats) {
+		recv = append(recv, ps)
+	}
+
+	var results []Result
+	p.OnResult = func(res Result) {
+		results = append(results, res)
+	}
+
+	p.Replay(Result{Time: clk.Now(), Dst: "192.168.0.1", Success: true, RTT: 10 * time.Millisecond})
+	clk.Advance(1 * time.Second)
+	p.Replay(Result{Time: clk.Now(), Dst: "192.168.0.1", Err: ErrNoResponse})
+	p.Replay(Result{Time: clk.Now(), Dst: "192.168.0.2", Success: true, RTT: 20 * time.Millisecond})
+
+	if len(recv) != 3 {
+		t.Fatalf("Expected 3 calls to OnRecv, got %d", len(recv))
+	}
+
+	if len(results) != 3 || results[1].Err != ErrNoResponse {
+		t.Fatalf("Expected 3 results to be passed to OnResult, got %+v", results)
+	}
+
+	snapshot := p.Stats()
+
+	ps, _ := snapshot.Get("192.168.0.1")
+	if ps.Loss != 50 || ps.Priority != 1 || ps.Sent != 2 {
+		t.Fatalf("Unexpected stats for 192.168.0.1: loss %v, priority %v, sent %v", ps.Loss, ps.Priority, ps.Sent)
+	}
+
+	ps, ok := snapshot.Get("192.168.0.2")
+	if !ok || ps.RTT != 20*time.Millisecond {
+		t.Fatalf("Expected a probe to be created for 192.168.0.2")
+	}
+
+	err := p.StopProbe("192.168.0.2")
+	if err != nil || p.Stats().Len() != 1 {
+		t.Fatalf("Expected 192.168.0.2 to be stopped (%v)", err)
+	}
+}
+
+func TestRestoredState(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clk := clock.NewFake(start)
+	p := NewReplayPinger([]Probe{{Dst: "192.168.0.1"}}, WithClock(clk), WithNumSeconds(10), WithWindows(map[string]uint{"long": 60}))
+
+	p.Replay(Result{Time: clk.Now(), Dst: "192.168.0.1", Success: true, RTT: 10 * time.Millisecond})
+	clk.Advance(1 * time.Second)
+	p.Replay(Result{Time: clk.Now(), Dst: "192.168.0.1", Err: ErrNoResponse})
+
+	// Round trip through JSON, as when the state is saved to a file
+	b, err := json.Marshal(p.State())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var states map[string]ProbeState
+	if err := json.Unmarshal(b, &states); err != nil {
+		t.Fatal(err)
+	}
+
+	clk.Advance(5 * time.Second)
+	restored := NewReplayPinger([]Probe{{Dst: "192.168.0.1"}}, WithClock(clk), WithNumSeconds(10), WithWindows(map[string]uint{"long": 60}), WithRestoredState(states))
+
+	ps, ok := restored.Stats().Get("192.168.0.1")
+	if !ok {
+		t.Fatal("Expected restored stats for 192.168.0.1")
+	}
+
+	if ps.Loss != 50 || ps.Sent != 2 || ps.FailureStreak != 1 || ps.RTT != 10*time.Millisecond {
+		t.Fatalf("Unexpected restored stats: loss %v, sent %v, failure streak %v, RTT %v", ps.Loss, ps.Sent, ps.FailureStreak, ps.RTT)
+	}
+
+	if ps.Windows["long"].Sent != 2 {
+		t.Fatalf("Expected 2 sent in restored window, got %d", ps.Windows["long"].Sent)
+	}
+
+	// The default window expires as usual
+	clk.Advance(5 * time.Second)
+	restored.Replay(Result{Time: clk.Now(), Dst: "192.168.0.1", Success: true, RTT: 20 * time.Millisecond})
+
+	ps, _ = restored.Stats().Get("192.168.0.1")
+	if ps.WindowSent != 1 || ps.Sent != 3 || ps.Windows["long"].Sent != 3 {
+		t.Fatalf("Unexpected stats after expiry: window sent %v, sent %v, long window sent %v", ps.WindowSent, ps.Sent, ps.Windows["long"].Sent)
+	}
+}
+
+// savedState returns the saved state of a Pinger with one result for 192.168.0.1, round tripped
+// through JSON as when the state is saved to a file
+func savedState(t *testing.T, clk clock.Clock, options ...Option) map[string]ProbeState {
+	t.Helper()
+
+	p := NewReplayPinger([]Probe{{Dst: "192.168.0.1"}}, append([]Option{WithClock(clk)}, options...)...)
+	p.Replay(Result{Time: clk.Now(), Dst: "192.168.0.1", Err: ErrNoResponse})
+
+	b, err := json.Marshal(p.State())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var states map[string]ProbeState
+	if err := json.Unmarshal(b, &states); err != nil {
+		t.Fatal(err)
+	}
+
+	return states
+}
+
+func TestRestoredStateExpired(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	options := []Option{WithClock(clk), WithNumSeconds(10), WithWindows(map[string]uint{"long": 120})}
+	states := savedState(t, clk, options...)
+
+	// The default window has expired, but the long one has not
+	clk.Advance(60 * time.Second)
+	restored := NewReplayPinger([]Probe{{Dst: "192.168.0.1"}}, append(options, WithRestoredState(states))...)
+
+	stats := restored.Stats()
+	if _, ok := stats.Get("192.168.0.1"); ok {
+		t.Fatal("Expected no stats for a probe whose default window has expired")
+	}
+
+	if _, ok := stats.LowestLoss(); ok {
+		t.Fatal("Expected no probe with the lowest loss")
+	}
+
+	_, err := json.Marshal(stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored.Replay(Result{Time: clk.Now(), Dst: "192.168.0.1", Success: true, RTT: 10 * time.Millisecond})
+
+	ps, ok := restored.Stats().Get("192.168.0.1")
+	if !ok {
+		t.Fatal("Expected stats for 192.168.0.1 after a result")
+	}
+
+	if ps.Loss != 0 || ps.WindowSent != 1 || ps.Sent != 2 || ps.Windows["long"].Sent != 2 || ps.Windows["long"].Loss != 50 {
+		t.Fatalf("Unexpected stats: loss %v, window sent %v, sent %v, long window %+v", ps.Loss, ps.WindowSent, ps.Sent, ps.Windows["long"])
+	}
+}
+
+func TestRestoredStateChangedWindow(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	states := savedState(t, clk, WithNumSeconds(10), WithWindows(map[string]uint{"long": 120}))
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+
+	// The long window has changed length, so it starts out empty, but the rest is restored
+	restored := NewReplayPinger([]Probe{{Dst: "192.168.0.1"}}, WithClock(clk), WithNumSeconds(10),
+		WithWindows(map[string]uint{"long": 30}), WithLogger(logger), WithRestoredState(states))
+
+	ps, ok := restored.Stats().Get("192.168.0.1")
+	if !ok {
+		t.Fatal("Expected restored stats for 192.168.0.1")
+	}
+
+	if ps.Loss != 100 || ps.Sent != 1 || ps.Windows["long"].Sent != 0 || ps.Windows["long"].Loss != 0 {
+		t.Fatalf("Unexpected restored stats: loss %v, sent %v, long window %+v", ps.Loss, ps.Sent, ps.Windows["long"])
+	}
+
+	if !strings.Contains(logs.String(), "could not restore some probe statistics") || !strings.Contains(logs.String(), `window \"long\"`) {
+		t.Errorf("Expected the long window's error to be logged: %s", logs.String())
+	}
+}
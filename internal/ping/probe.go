@@ -3,18 +3,24 @@ package ping
 import (
 	"context"
 	"fmt"
-	"log"
 	"net"
 	"sync"
 	"time"
 
-	probing "github.com/prometheus-community/pro-bing"
+	"github.com/sector-f/failoverd/internal/clock"
 	"github.com/vishvananda/netlink"
 )
 
 type Probe struct {
 	Src string
 	Dst string
+
+	// Priority is used to break ties between probes with equal scores. Lower values are preferred.
+	Priority int
+
+	// Windows maps names to window lengths in seconds. These are tracked in addition to
+	// the windows given to the Pinger via WithWindows.
+	Windows map[string]uint
 }
 
 // newProbe takes in a Probe and validates its addresses
@@ -29,40 +35,48 @@ func newProbe(probe Probe) (Probe, error) {
 	// If specified source is not an address, treat it as a network interface name
 	// and attempt to determine its address using netlink.
 	if probe.Src != "" && net.ParseIP(probe.Src) == nil {
-		link, err := netlink.LinkByName(probe.Src)
+		addr, err := InterfaceAddress(probe.Src)
 		if err != nil {
-			return Probe{}, fmt.Errorf("could not determine address of %s: %w", probe.Src, err)
+			return Probe{}, err
 		}
 
-		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4) // TODO: Handle IPv6?
-		if err != nil {
-			return Probe{}, fmt.Errorf("could not determine address of %s: %w", probe.Src, err)
-		}
+		validated.Src = addr.String()
+	}
 
-		if len(addrs) == 0 {
-			return Probe{}, fmt.Errorf("interface has no addresses")
-		}
+	return validated, nil
+}
 
-		validated.Src = addrs[0].IP.String() // TODO: figure out if there's a better way to pick an address than just "use the first one"
+// InterfaceAddress returns the IPv4 address of a network interface, which is used as the source
+// address of probes that name the interface.
+func InterfaceAddress(name string) (net.IP, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not determine address of %s: %w", name, err)
 	}
 
-	return validated, nil
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4) // TODO: Handle IPv6?
+	if err != nil {
+		return nil, fmt.Errorf("could not determine address of %s: %w", name, err)
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("interface has no addresses")
+	}
+
+	return addrs[0].IP, nil // TODO: figure out if there's a better way to pick an address than just "use the first one"
+}
+
+// ValidateProbe checks that a probe's destination is an IP address and that its source,
+// if it is an interface name, refers to an interface with an address.
+func ValidateProbe(probe Probe) error {
+	_, err := newProbe(probe)
+	return err
 }
 
-func (probe *Probe) run(pingFrequency time.Duration, privileged bool, statCh chan ProbeStats, stopChan chan struct{}, wg *sync.WaitGroup) {
-	wg.Add(1)
+func (probe *Probe) run(prober Prober, clk clock.Clock, pingFrequency time.Duration, statCh chan Result, stopChan chan struct{}, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	for {
-		pinger, err := probing.NewPinger(probe.Dst)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		pinger.Source = probe.Src
-
-		// This is all working around Pinger.Run() not taking a context.
-		//
 		// The desired behavior is as follows:
 		//   * Send a ping request at a fixed period, e.g. once per second, and wait for a response.
 		//
@@ -74,56 +88,54 @@ func (probe *Probe) run(pingFrequency time.Duration, privileged bool, statCh cha
 		//     E.g. if we are sending one request per second, and we receive a response after 100ms, then
 		//     we still want to wait the remaining 900ms before sending the next request.
 
-		finishedChan := make(chan *probing.Statistics)
-		pinger.OnFinish = func(stats *probing.Statistics) {
-			finishedChan <- stats
-		}
+		// Create a timer that fires once we want to send the next ping
+		timer := clk.NewTimer(pingFrequency)
 
-		// Note that we never set a timeout on the pinger itself
-		pinger.SetPrivileged(privileged)
-		pinger.Count = 1
+		ctx, cancelFunc := context.WithCancel(context.Background())
+		resultChan := make(chan Result, 1) // Buffered so the ping can finish after we stop waiting for it
 		go func() {
-			pinger.Run() // Blocks until it has dealt with a packet
+			rtt, err := prober.Ping(ctx, *probe)
+			resultChan <- Result{
+				Time:    clk.Now(),
+				Src:     probe.Src,
+				Dst:     probe.Dst,
+				Success: err == nil,
+				RTT:     rtt,
+				Err:     err,
+			}
 		}()
 
-		// Create a context that is canceled once we want to send the next ping
-		ctx, cancelFunc := context.WithTimeout(context.Background(), pingFrequency)
-
 		// At this point, three things can happen:
 		//   * We get a response to the ping request in time
 		//   * We _don't_ get a response to the ping request in time, and therefore time out
 		//   * Stop() is called, so we want to abandon the running ping
 		select {
-		case stats := <-finishedChan:
-			ps := ProbeStats{
-				Src:  probe.Src,
-				Dst:  probe.Dst,
-				Loss: stats.PacketLoss,
-			}
-			statCh <- ps
-		case <-ctx.Done():
+		case res := <-resultChan:
+			cancelFunc()
+			statCh <- res
+		case <-timer.C():
 			// Timed out
-			pinger.Stop()
-			ps := ProbeStats{
+			cancelFunc()
+			statCh <- Result{
+				Time: clk.Now(),
 				Src:  probe.Src,
 				Dst:  probe.Dst,
-				Loss: 100.0, // We're only sending one ping at a time, so a timeout means 100% packet loss
+				Err:  ErrNoResponse,
 			}
-			statCh <- ps
+
+			// The timer has already fired, so there is no need to wait for it below
+			continue
 		case <-stopChan:
 			cancelFunc()
+			timer.Stop()
 			return
 		}
 
 		select {
+		case <-timer.C():
 		case <-stopChan:
-			cancelFunc()
+			timer.Stop()
 			return
-		default:
-			// Do nothing
 		}
-
-		<-ctx.Done()
-		cancelFunc()
 	}
 }
@@ -0,0 +1,77 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	probing "github.com/prometheus-community/pro-bing"
+)
+
+// ErrNoResponse is returned by a Prober when a ping does not receive a response.
+var ErrNoResponse = errors.New("no response")
+
+// Prober sends pings on behalf of a Pinger.
+type Prober interface {
+	// Ping sends a single ping to probe.Dst from probe.Src and waits for the response,
+	// returning the round-trip time. It returns an error if no response is received,
+	// including if ctx is canceled before one arrives.
+	Ping(ctx context.Context, probe Probe) (time.Duration, error)
+}
+
+// Result is the outcome of a single ping.
+type Result struct {
+	Time    time.Time
+	Src     string
+	Dst     string
+	Success bool
+	RTT     time.Duration // Only meaningful if Success is true
+	Err     error         // Only meaningful if Success is false
+}
+
+// ICMPProber is a Prober that sends ICMP echo requests, or UDP pings if Privileged is false.
+type ICMPProber struct {
+	Privileged bool
+}
+
+func (p ICMPProber) Ping(ctx context.Context, probe Probe) (time.Duration, error) {
+	pinger, err := probing.NewPinger(probe.Dst)
+	if err != nil {
+		return 0, err
+	}
+	pinger.Source = probe.Src
+
+	// This is all working around Pinger.Run() not taking a context: the ping is
+	// abandoned by calling Stop() once ctx is canceled.
+	finishedChan := make(chan *probing.Statistics, 1) // Buffered so OnFinish doesn't block after a timeout
+	pinger.OnFinish = func(stats *probing.Statistics) {
+		finishedChan <- stats
+	}
+
+	// Note that we never set a timeout on the pinger itself
+	pinger.SetPrivileged(p.Privileged)
+	pinger.Count = 1
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- pinger.Run() // Blocks until it has dealt with a packet
+	}()
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			return 0, err
+		}
+
+		// OnFinish is called before Run returns successfully
+		stats := <-finishedChan
+		if stats.PacketsRecv == 0 {
+			return 0, ErrNoResponse
+		}
+
+		return stats.AvgRtt, nil
+	case <-ctx.Done():
+		pinger.Stop()
+		return 0, ErrNoResponse
+	}
+}
@@ -1,30 +1,201 @@
 package ping
 
+import (
+	"net/netip"
+	"sort"
+	"time"
+)
+
 type ProbeStats struct {
-	Src  string
-	Dst  string
-	Loss float64
-}
-
-/*
-func (gps GlobalProbeStats) LowestLoss() ProbeStats {
-	var (
-		lowestProbeStats ProbeStats
-		first            bool = true
-	)
-
-	for _, stats := range gps.Stats {
-		if first {
-			lowestProbeStats = stats
-			first = false
-			continue
+	Src      string
+	Dst      string
+	Priority int
+
+	Loss   float64
+	RTT    time.Duration // Average round-trip time of successful pings
+	Jitter time.Duration // Average difference between consecutive round-trip times
+	HasRTT bool          // Whether any pings in the window were successful
+
+	// Round-trip time distribution of successful pings within the window.
+	// Percentiles are approximate, to within 1%.
+	RTTMin time.Duration
+	RTTMax time.Duration
+	RTTP50 time.Duration
+	RTTP95 time.Duration
+	RTTP99 time.Duration
+
+	// Exponentially weighted moving averages, which are not limited to a window.
+	// RTTEWMA is only meaningful if Received is non-zero.
+	LossEWMA float64
+	RTTEWMA  time.Duration
+
+	Sent           uint64 // Pings sent since the probe started
+	Received       uint64 // Responses received since the probe started
+	WindowSent     uint   // Pings sent within the window
+	WindowReceived uint   // Responses received within the window
+
+	Time        time.Time // When the statistics were collected. In a Snapshot, this is the Snapshot's timestamp.
+	Started     time.Time // When the probe was started
+	Updated     time.Time // When the most recent result was received
+	LastSuccess time.Time // Zero if no response has ever been received
+	LastFailure time.Time // Zero if no ping has ever been lost
+
+	SuccessStreak uint64 // Number of consecutive successful pings
+	FailureStreak uint64 // Number of consecutive lost pings
+
+	Windows map[string]WindowStats // Statistics for each named window
+}
+
+// WindowStats holds the statistics of a probe over a single window.
+type WindowStats struct {
+	Loss   float64
+	RTT    time.Duration
+	Jitter time.Duration
+	HasRTT bool
+
+	RTTMin time.Duration
+	RTTMax time.Duration
+	RTTP50 time.Duration
+	RTTP95 time.Duration
+	RTTP99 time.Duration
+
+	Sent     uint
+	Received uint
+}
+
+// Window returns the statistics for the named window. The empty string names the default window.
+func (ps ProbeStats) Window(name string) (WindowStats, bool) {
+	if name == "" {
+		return WindowStats{
+			Loss:     ps.Loss,
+			RTT:      ps.RTT,
+			Jitter:   ps.Jitter,
+			HasRTT:   ps.HasRTT,
+			RTTMin:   ps.RTTMin,
+			RTTMax:   ps.RTTMax,
+			RTTP50:   ps.RTTP50,
+			RTTP95:   ps.RTTP95,
+			RTTP99:   ps.RTTP99,
+			Sent:     ps.WindowSent,
+			Received: ps.WindowReceived,
+		}, true
+	}
+
+	ws, ok := ps.Windows[name]
+	return ws, ok
+}
+
+// Age returns how long the probe had been running when the statistics were collected.
+// It keeps growing while no results are received.
+func (ps ProbeStats) Age() time.Duration {
+	if ps.Started.IsZero() || ps.Time.Before(ps.Started) {
+		return 0
+	}
+
+	return ps.Time.Sub(ps.Started)
+}
+
+// clone returns a deep copy of ps.
+func (ps ProbeStats) clone() ProbeStats {
+	if ps.Windows != nil {
+		windows := make(map[string]WindowStats, len(ps.Windows))
+		for name, ws := range ps.Windows {
+			windows[name] = ws
 		}
+		ps.Windows = windows
+	}
+
+	return ps
+}
+
+// CompareDst compares two destination addresses, returning -1, 0 or +1. IP addresses are compared
+// numerically, so 10.0.0.9 comes before 10.0.0.10, and IPv4 addresses before IPv6 addresses.
+// Anything else (e.g. a hostname) comes after every IP address, in lexical order.
+func CompareDst(a string, b string) int {
+	aAddr, aErr := netip.ParseAddr(a)
+	bAddr, bErr := netip.ParseAddr(b)
+
+	switch {
+	case aErr == nil && bErr == nil:
+		return aAddr.Compare(bAddr)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Snapshot is a point-in-time copy of the statistics of every running probe.
+// It is not modified by the Pinger after it is created, so it is safe to read
+// from any goroutine.
+type Snapshot struct {
+	Timestamp time.Time
+
+	stats []ProbeStats // Sorted by destination address
+}
+
+// NewSnapshot returns a Snapshot containing a copy of gps.
+func NewSnapshot(timestamp time.Time, gps map[string]ProbeStats) Snapshot {
+	stats := make([]ProbeStats, 0, len(gps))
+	for _, ps := range gps {
+		ps = ps.clone()
+		ps.Time = timestamp
+		stats = append(stats, ps)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return CompareDst(stats[i].Dst, stats[j].Dst) < 0
+	})
+
+	return Snapshot{
+		Timestamp: timestamp,
+		stats:     stats,
+	}
+}
+
+// Len returns the number of probes in the snapshot.
+func (s Snapshot) Len() int {
+	return len(s.stats)
+}
+
+// Get returns the statistics of the probe with the given destination address.
+func (s Snapshot) Get(dst string) (ProbeStats, bool) {
+	i := sort.Search(len(s.stats), func(i int) bool {
+		return CompareDst(s.stats[i].Dst, dst) >= 0
+	})
+
+	if i < len(s.stats) && s.stats[i].Dst == dst {
+		return s.stats[i].clone(), true
+	}
+
+	return ProbeStats{}, false
+}
+
+// Sorted returns the statistics of every probe, sorted by destination address.
+func (s Snapshot) Sorted() []ProbeStats {
+	stats := make([]ProbeStats, len(s.stats))
+	for i, ps := range s.stats {
+		stats[i] = ps.clone()
+	}
+
+	return stats
+}
 
-		if stats.Loss < lowestProbeStats.Loss {
-			lowestProbeStats = stats
+// LowestLoss returns the statistics of the probe with the lowest packet loss.
+// Ties are broken by destination address. ok is false if the snapshot is empty.
+func (s Snapshot) LowestLoss() (lowest ProbeStats, ok bool) {
+	for i, ps := range s.stats {
+		if i == 0 || ps.Loss < lowest.Loss {
+			lowest = ps
+			ok = true
 		}
 	}
 
-	return lowestProbeStats
+	return lowest.clone(), ok
 }
-*/
@@ -0,0 +1,81 @@
+package ping
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotIsACopy(t *testing.T) {
+	gps := map[string]ProbeStats{
+		"192.168.0.1": {Dst: "192.168.0.1", Loss: 10},
+	}
+
+	s := NewSnapshot(time.Now(), gps)
+	gps["192.168.0.1"] = ProbeStats{Dst: "192.168.0.1", Loss: 50}
+	gps["192.168.0.2"] = ProbeStats{Dst: "192.168.0.2", Loss: 0}
+
+	if s.Len() != 1 {
+		t.Fatalf("Expected 1 probe, got %d", s.Len())
+	}
+
+	ps, ok := s.Get("192.168.0.1")
+	if !ok || ps.Loss != 10 {
+		t.Fatalf("Expected loss of 10, got %v", ps.Loss)
+	}
+}
+
+func TestSnapshotSorted(t *testing.T) {
+	s := NewSnapshot(time.Now(), map[string]ProbeStats{
+		"192.168.0.10": {Dst: "192.168.0.10"},
+		"192.168.0.9":  {Dst: "192.168.0.9"},
+		"192.168.0.2":  {Dst: "192.168.0.2"},
+		"::1":          {Dst: "::1"},
+	})
+
+	for i, ps := range s.Sorted() {
+		expected := []string{"192.168.0.2", "192.168.0.9", "192.168.0.10", "::1"}[i]
+		if ps.Dst != expected {
+			t.Fatalf("Expected %s at index %d, got %s", expected, i, ps.Dst)
+		}
+	}
+
+	if _, ok := s.Get("192.168.0.10"); !ok {
+		t.Fatalf("Expected 192.168.0.10 to be present")
+	}
+
+	if _, ok := s.Get("192.168.0.4"); ok {
+		t.Fatalf("Expected 192.168.0.4 to be missing")
+	}
+}
+
+func TestSnapshotLowestLoss(t *testing.T) {
+	s := NewSnapshot(time.Now(), map[string]ProbeStats{
+		"192.168.0.2": {Dst: "192.168.0.2", Loss: 0},
+		"192.168.0.1": {Dst: "192.168.0.1", Loss: 20},
+		"192.168.0.3": {Dst: "192.168.0.3", Loss: 0},
+	})
+
+	ps, ok := s.LowestLoss()
+	if !ok || ps.Dst != "192.168.0.2" {
+		t.Fatalf("Expected 192.168.0.2, got %s", ps.Dst)
+	}
+
+	_, ok = Snapshot{}.LowestLoss()
+	if ok {
+		t.Fatalf("Expected empty snapshot to have no lowest loss")
+	}
+}
+
+func TestSnapshotAge(t *testing.T) {
+	started := time.Unix(1000, 0)
+
+	// No results have been received for a minute, but the probe is still getting older
+	s := NewSnapshot(started.Add(65*time.Second), map[string]ProbeStats{
+		"192.168.0.1": {Dst: "192.168.0.1", Started: started, Updated: started.Add(5 * time.Second)},
+	})
+
+	ps, _ := s.Get("192.168.0.1")
+	if ps.Age() != 65*time.Second {
+		t.Fatalf("Expected age of 65s, got %v", ps.Age())
+	}
+}
@@ -0,0 +1,163 @@
+package ping
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	rb "github.com/sector-f/failoverd/internal/ringbuffer"
+)
+
+// ProbeState is the saved statistics of a probe, from which they can be restored after a restart.
+type ProbeState struct {
+	Windows map[string]WindowState `json:"windows"` // The default window has the name ""
+
+	LossEWMA *float64 `json:"loss_ewma,omitempty"` // Nil if no results had been received
+	RTTEWMA  *float64 `json:"rtt_ewma,omitempty"`  // Nil if no successful results had been received
+
+	LastRTT *time.Duration `json:"last_rtt,omitempty"`
+
+	Started     time.Time `json:"started"`
+	Updated     time.Time `json:"updated"`
+	LastSuccess time.Time `json:"last_success"`
+	LastFailure time.Time `json:"last_failure"`
+
+	Sent     uint64 `json:"sent"`
+	Received uint64 `json:"received"`
+
+	SuccessStreak uint64 `json:"success_streak"`
+	FailureStreak uint64 `json:"failure_streak"`
+}
+
+// WindowState is the saved contents of a window's ring buffers.
+type WindowState struct {
+	Loss   rb.State `json:"loss"`
+	RTT    rb.State `json:"rtt"`
+	Jitter rb.State `json:"jitter"`
+}
+
+func (w *window) state() WindowState {
+	return WindowState{
+		Loss:   w.loss.State(),
+		RTT:    w.rtt.State(),
+		Jitter: w.jitter.State(),
+	}
+}
+
+func (w *window) restore(s WindowState) error {
+	if err := w.loss.Restore(s.Loss); err != nil {
+		return err
+	}
+
+	if err := w.rtt.Restore(s.RTT); err != nil {
+		return err
+	}
+
+	return w.jitter.Restore(s.Jitter)
+}
+
+func (t *tracker) state() ProbeState {
+	s := ProbeState{
+		Windows: make(map[string]WindowState, len(t.windows)+1),
+
+		Started:     t.started,
+		Updated:     t.updated,
+		LastSuccess: t.lastSuccess,
+		LastFailure: t.lastFailure,
+
+		Sent:     t.sent,
+		Received: t.received,
+
+		SuccessStreak: t.successStreak,
+		FailureStreak: t.failureStreak,
+	}
+
+	s.Windows[""] = t.window.state()
+	for name, w := range t.windows {
+		s.Windows[name] = w.state()
+	}
+
+	if v, ok := t.lossEWMA.Value(); ok {
+		s.LossEWMA = &v
+	}
+
+	if v, ok := t.rttEWMA.Value(); ok {
+		s.RTTEWMA = &v
+	}
+
+	if t.hasLastRTT {
+		lastRTT := t.lastRTT
+		s.LastRTT = &lastRTT
+	}
+
+	return s
+}
+
+// restore replaces the tracker's statistics with saved ones. Windows which did not exist when
+// the state was saved start out empty, as do those that cannot be restored, e.g. because their
+// length has changed; the returned error says which. The rest of the statistics are restored anyway.
+func (t *tracker) restore(s ProbeState) error {
+	var errs []error
+
+	if ws, ok := s.Windows[""]; ok {
+		if err := t.window.restore(ws); err != nil {
+			errs = append(errs, fmt.Errorf("default window: %w", err))
+		}
+	}
+
+	for name, w := range t.windows {
+		if ws, ok := s.Windows[name]; ok {
+			if err := w.restore(ws); err != nil {
+				errs = append(errs, fmt.Errorf("window %q: %w", name, err))
+			}
+		}
+	}
+
+	if s.LossEWMA != nil {
+		t.lossEWMA.Restore(*s.LossEWMA)
+	}
+
+	if s.RTTEWMA != nil {
+		t.rttEWMA.Restore(*s.RTTEWMA)
+	}
+
+	if s.LastRTT != nil {
+		t.lastRTT = *s.LastRTT
+		t.hasLastRTT = true
+	}
+
+	t.started = s.Started
+	t.updated = s.Updated
+	t.lastSuccess = s.LastSuccess
+	t.lastFailure = s.LastFailure
+
+	t.sent = s.Sent
+	t.received = s.Received
+
+	t.successStreak = s.SuccessStreak
+	t.failureStreak = s.FailureStreak
+
+	return errors.Join(errs...)
+}
+
+// State returns the statistics of every probe in a form that can be saved, mapped by
+// destination, for use with WithRestoredState.
+func (p *Pinger) State() map[string]ProbeState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	states := make(map[string]ProbeState, len(p.statTracker))
+	for dst, t := range p.statTracker {
+		states[dst] = t.state()
+	}
+
+	return states
+}
+
+// WithRestoredState sets statistics saved by State to restore. Each probe's statistics are
+// restored when it is first started, if its destination has saved statistics.
+func WithRestoredState(states map[string]ProbeState) Option {
+	return func(p *Pinger) {
+		p.restored = states
+	}
+}
@@ -0,0 +1,227 @@
+package ping
+
+import (
+	"time"
+
+	"github.com/sector-f/failoverd/internal/clock"
+	rb "github.com/sector-f/failoverd/internal/ringbuffer"
+)
+
+// maxWindowSlots limits the memory used by each window's ring buffers.
+// Windows longer than this many seconds expire values more than one second at a time.
+const maxWindowSlots = 120
+
+// tracker accumulates the results of a single probe.
+type tracker struct {
+	probe Probe
+	clock clock.Clock
+
+	window  *window            // The default window, whose length is set by WithNumSeconds
+	windows map[string]*window // Additional named windows
+
+	lossEWMA *rb.EWMA
+	rttEWMA  *rb.EWMA
+
+	lastRTT    time.Duration
+	hasLastRTT bool
+
+	started     time.Time
+	updated     time.Time
+	lastSuccess time.Time
+	lastFailure time.Time
+
+	sent     uint64
+	received uint64
+
+	successStreak uint64
+	failureStreak uint64
+}
+
+// window tracks the results of a probe over a period of time.
+type window struct {
+	loss   *rb.RingBuffer
+	rtt    *rb.RingBuffer // Only contains successful pings
+	jitter *rb.RingBuffer // Absolute differences between consecutive RTTs
+}
+
+func newWindow(seconds uint, clk clock.Clock) *window {
+	return &window{
+		loss:   rb.NewWithResolution(seconds, maxWindowSlots, rb.WithClock(clk)),
+		rtt:    rb.NewWithResolution(seconds, maxWindowSlots, rb.WithClock(clk), rb.WithPercentiles()),
+		jitter: rb.NewWithResolution(seconds, maxWindowSlots, rb.WithClock(clk)),
+	}
+}
+
+func (w *window) stats() WindowStats {
+	ws := WindowStats{
+		Sent:     w.loss.Count(),
+		Received: w.rtt.Count(),
+	}
+
+	// A restored window may be empty, and the average of nothing is NaN
+	if ws.Sent > 0 {
+		ws.Loss = w.loss.Average()
+	}
+
+	if w.rtt.Count() > 0 {
+		ws.HasRTT = true
+		ws.RTT = time.Duration(w.rtt.Average())
+
+		min, _ := w.rtt.Min()
+		max, _ := w.rtt.Max()
+		p50, _ := w.rtt.Percentile(50)
+		p95, _ := w.rtt.Percentile(95)
+		p99, _ := w.rtt.Percentile(99)
+
+		ws.RTTMin = time.Duration(min)
+		ws.RTTMax = time.Duration(max)
+		ws.RTTP50 = time.Duration(p50)
+		ws.RTTP95 = time.Duration(p95)
+		ws.RTTP99 = time.Duration(p99)
+	}
+
+	if w.jitter.Count() > 0 {
+		ws.Jitter = time.Duration(w.jitter.Average())
+	}
+
+	return ws
+}
+
+// trackerOptions holds the Pinger-wide settings used to create trackers.
+type trackerOptions struct {
+	seconds   uint            // Length of the default window
+	windows   map[string]uint // Named windows
+	ewmaAlpha float64
+	clock     clock.Clock
+}
+
+// newTracker returns a tracker for the given probe. The probe's named windows are added
+// to the named windows in opts, overriding any with the same name.
+func newTracker(probe Probe, opts trackerOptions, started time.Time) *tracker {
+	t := &tracker{
+		probe:   probe,
+		clock:   opts.clock,
+		started: started,
+
+		window:  newWindow(opts.seconds, opts.clock),
+		windows: make(map[string]*window),
+
+		lossEWMA: rb.NewEWMA(opts.ewmaAlpha),
+		rttEWMA:  rb.NewEWMA(opts.ewmaAlpha),
+	}
+
+	for name, seconds := range opts.windows {
+		t.windows[name] = newWindow(seconds, opts.clock)
+	}
+
+	for name, seconds := range probe.Windows {
+		t.windows[name] = newWindow(seconds, opts.clock)
+	}
+
+	return t
+}
+
+// allWindows returns the default window followed by the named windows.
+func (t *tracker) allWindows() []*window {
+	windows := make([]*window, 0, len(t.windows)+1)
+	windows = append(windows, t.window)
+	for _, w := range t.windows {
+		windows = append(windows, w)
+	}
+
+	return windows
+}
+
+func (t *tracker) insert(res Result) {
+	loss := 0.0
+	if !res.Success {
+		loss = 100.0
+	}
+
+	for _, w := range t.allWindows() {
+		w.loss.Insert(loss)
+	}
+	t.lossEWMA.Insert(loss)
+	t.sent++
+	t.updated = res.Time
+
+	if !res.Success {
+		t.lastFailure = res.Time
+		t.failureStreak++
+		t.successStreak = 0
+		return
+	}
+
+	t.lastSuccess = res.Time
+	t.received++
+	t.successStreak++
+	t.failureStreak = 0
+
+	for _, w := range t.allWindows() {
+		w.rtt.Insert(float64(res.RTT))
+	}
+	t.rttEWMA.Insert(float64(res.RTT))
+
+	if t.hasLastRTT {
+		diff := res.RTT - t.lastRTT
+		if diff < 0 {
+			diff = -diff
+		}
+
+		for _, w := range t.allWindows() {
+			w.jitter.Insert(float64(diff))
+		}
+	}
+
+	t.lastRTT = res.RTT
+	t.hasLastRTT = true
+}
+
+func (t *tracker) stats(src string) ProbeStats {
+	ws := t.window.stats()
+
+	ps := ProbeStats{
+		Src:      src,
+		Dst:      t.probe.Dst,
+		Priority: t.probe.Priority,
+
+		Loss:   ws.Loss,
+		RTT:    ws.RTT,
+		Jitter: ws.Jitter,
+		HasRTT: ws.HasRTT,
+
+		RTTMin: ws.RTTMin,
+		RTTMax: ws.RTTMax,
+		RTTP50: ws.RTTP50,
+		RTTP95: ws.RTTP95,
+		RTTP99: ws.RTTP99,
+
+		Sent:           t.sent,
+		Received:       t.received,
+		WindowSent:     ws.Sent,
+		WindowReceived: ws.Received,
+
+		Time:        t.clock.Now(),
+		Started:     t.started,
+		Updated:     t.updated,
+		LastSuccess: t.lastSuccess,
+		LastFailure: t.lastFailure,
+
+		SuccessStreak: t.successStreak,
+		FailureStreak: t.failureStreak,
+	}
+
+	lossEWMA, _ := t.lossEWMA.Value()
+	rttEWMA, _ := t.rttEWMA.Value()
+	ps.LossEWMA = lossEWMA
+	ps.RTTEWMA = time.Duration(rttEWMA)
+
+	if len(t.windows) > 0 {
+		ps.Windows = make(map[string]WindowStats, len(t.windows))
+		for name, w := range t.windows {
+			ps.Windows[name] = w.stats()
+		}
+	}
+
+	return ps
+}
@@ -0,0 +1,80 @@
+package ping
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/sector-f/failoverd/internal/clock"
+)
+
+func TestTrackerCounters(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clk := clock.NewFake(start)
+	tr := newTracker(Probe{Dst: "192.168.0.1"}, trackerOptions{seconds: 10, ewmaAlpha: 0.5, clock: clk}, start)
+
+	results := []Result{
+		{Success: true, RTT: 10 * time.Millisecond},
+		{Success: true, RTT: 20 * time.Millisecond},
+		{Success: false},
+		{Success: true, RTT: 10 * time.Millisecond},
+		{Success: true, RTT: 10 * time.Millisecond},
+	}
+	for _, res := range results {
+		clk.Advance(1 * time.Second)
+		res.Time = clk.Now()
+		tr.insert(res)
+	}
+
+	ps := tr.stats("")
+
+	if ps.Sent != 5 || ps.Received != 4 {
+		t.Fatalf("Expected 5 sent and 4 received, got %d and %d", ps.Sent, ps.Received)
+	}
+
+	if ps.WindowSent != 5 || ps.WindowReceived != 4 {
+		t.Fatalf("Expected 5 sent and 4 received in window, got %d and %d", ps.WindowSent, ps.WindowReceived)
+	}
+
+	if ps.SuccessStreak != 2 || ps.FailureStreak != 0 {
+		t.Fatalf("Expected streaks of 2 and 0, got %d and %d", ps.SuccessStreak, ps.FailureStreak)
+	}
+
+	if !ps.LastFailure.Equal(start.Add(3*time.Second)) || !ps.LastSuccess.Equal(start.Add(5*time.Second)) {
+		t.Fatalf("Unexpected last success/failure times: %v, %v", ps.LastSuccess, ps.LastFailure)
+	}
+
+	if ps.Age() != 5*time.Second {
+		t.Fatalf("Expected age of 5s, got %v", ps.Age())
+	}
+
+	if ps.Loss != 20 {
+		t.Fatalf("Expected loss of 20, got %v", ps.Loss)
+	}
+
+	if ps.RTT != 12500*time.Microsecond {
+		t.Fatalf("Expected RTT of 12.5ms, got %v", ps.RTT)
+	}
+
+	// Jitter is the mean of |20-10|, |10-20| and |10-10|
+	if ps.Jitter != 20*time.Millisecond/3 {
+		t.Fatalf("Expected jitter of 6.67ms, got %v", ps.Jitter)
+	}
+
+	if ps.RTTMin != 10*time.Millisecond || ps.RTTMax != 20*time.Millisecond {
+		t.Fatalf("Expected RTT min and max of 10ms and 20ms, got %v and %v", ps.RTTMin, ps.RTTMax)
+	}
+
+	if math.Abs(float64(ps.RTTP50-10*time.Millisecond)) > 0.01*float64(10*time.Millisecond) {
+		t.Fatalf("Expected RTT p50 of about 10ms, got %v", ps.RTTP50)
+	}
+
+	if math.Abs(float64(ps.RTTP99-20*time.Millisecond)) > 0.01*float64(20*time.Millisecond) {
+		t.Fatalf("Expected RTT p99 of about 20ms, got %v", ps.RTTP99)
+	}
+
+	// With an alpha of 0.5: 0, 0, 50, 25, 12.5
+	if ps.LossEWMA != 12.5 {
+		t.Fatalf("Expected loss EWMA of 12.5, got %v", ps.LossEWMA)
+	}
+}
@@ -0,0 +1,38 @@
+package ringbuffer
+
+// EWMA is an exponentially weighted moving average. Unlike RingBuffer, values never
+// expire; instead, the weight of each value decays as newer values are inserted.
+type EWMA struct {
+	alpha       float64
+	value       float64
+	initialized bool
+}
+
+// NewEWMA returns an EWMA in which each new value has the given weight (0-1).
+// Larger values of alpha make the average respond more quickly to changes.
+func NewEWMA(alpha float64) *EWMA {
+	return &EWMA{
+		alpha: alpha,
+	}
+}
+
+func (e *EWMA) Insert(n float64) {
+	if !e.initialized {
+		e.value = n
+		e.initialized = true
+		return
+	}
+
+	e.value = e.alpha*n + (1-e.alpha)*e.value
+}
+
+// Value returns the current average. ok is false if no values have been inserted.
+func (e *EWMA) Value() (value float64, ok bool) {
+	return e.value, e.initialized
+}
+
+// Restore sets the current average, e.g. to a Value saved before a restart.
+func (e *EWMA) Restore(value float64) {
+	e.value = value
+	e.initialized = true
+}
@@ -0,0 +1,85 @@
+package ringbuffer
+
+import (
+	"math"
+	"sort"
+)
+
+// histogramGamma is the ratio between the upper bounds of consecutive histogram bins.
+// Every value in a bin is within (gamma-1)/(gamma+1) (just under 1%) of the bin's midpoint.
+const histogramGamma = 1.02
+
+// zeroBin holds values that are zero or negative, which cannot be binned logarithmically.
+const zeroBin = math.MinInt32
+
+var logGamma = math.Log(histogramGamma)
+
+// histogram is a sparse, logarithmically-binned histogram. Its size grows with the
+// range of values inserted, rather than the number of values.
+type histogram map[int]uint
+
+func binOf(v float64) int {
+	if v <= 0 {
+		return zeroBin
+	}
+
+	return int(math.Ceil(math.Log(v) / logGamma))
+}
+
+// binValue returns a representative value for the given bin
+func binValue(bin int) float64 {
+	if bin == zeroBin {
+		return 0
+	}
+
+	return 2 * math.Pow(histogramGamma, float64(bin)) / (histogramGamma + 1)
+}
+
+func (h *histogram) insert(v float64) {
+	if *h == nil {
+		*h = make(histogram)
+	}
+
+	(*h)[binOf(v)]++
+}
+
+func (h *histogram) merge(other histogram) {
+	for bin, count := range other {
+		if *h == nil {
+			*h = make(histogram)
+		}
+
+		(*h)[bin] += count
+	}
+}
+
+// percentile returns the value at the p-th percentile using the nearest-rank method
+func (h histogram) percentile(p float64) (float64, bool) {
+	var total uint
+	bins := make([]int, 0, len(h))
+	for bin, count := range h {
+		bins = append(bins, bin)
+		total += count
+	}
+
+	if total == 0 {
+		return 0, false
+	}
+
+	sort.Ints(bins)
+
+	rank := uint(math.Ceil(p / 100 * float64(total)))
+	if rank < 1 {
+		rank = 1
+	}
+
+	var seen uint
+	for _, bin := range bins {
+		seen += h[bin]
+		if seen >= rank {
+			return binValue(bin), true
+		}
+	}
+
+	return binValue(bins[len(bins)-1]), true
+}
@@ -5,11 +5,18 @@ package ringbuffer
 import (
 	"sync"
 	"time"
+
+	"github.com/sector-f/failoverd/internal/clock"
 )
 
 type bufferElement struct {
 	val         float64
 	insertCount uint
+
+	min float64 // Only meaningful if insertCount is non-zero
+	max float64 // Only meaningful if insertCount is non-zero
+
+	hist histogram // Only used if percentiles are enabled
 }
 
 type RingBuffer struct {
@@ -19,20 +26,84 @@ type RingBuffer struct {
 	sum         float64
 	insertCount uint
 
+	percentiles bool
+
+	clock        clock.Clock
+	slotDuration time.Duration
+	slotStart    time.Time // When the slot at pointer started receiving values
+
 	mu sync.Mutex
 }
 
-func New(seconds uint) *RingBuffer {
-	ticker := time.NewTicker(1 * time.Second)
-	return newWithChannel(seconds, ticker.C)
+type Option func(rb *RingBuffer)
+
+// WithPercentiles enables tracking of approximate percentiles, for use with Percentile.
+func WithPercentiles() Option {
+	return func(rb *RingBuffer) {
+		rb.percentiles = true
+	}
+}
+
+// WithClock sets the clock used to expire values. The default is clock.Real().
+func WithClock(c clock.Clock) Option {
+	return func(rb *RingBuffer) {
+		rb.clock = c
+	}
+}
+
+// New returns a RingBuffer that tracks the values inserted in the last given number of seconds,
+// with a resolution of one second.
+func New(seconds uint, options ...Option) *RingBuffer {
+	return NewWithResolution(seconds, seconds, options...)
+}
+
+// NewWithResolution returns a RingBuffer that tracks the values inserted in the last given
+// number of seconds using at most the given number of slots. Long windows can use this to
+// trade precision for memory: values expire one slot (seconds/slots seconds) at a time.
+func NewWithResolution(seconds uint, slots uint, options ...Option) *RingBuffer {
+	if seconds == 0 {
+		seconds = 1
+	}
+
+	if slots == 0 || slots > seconds {
+		slots = seconds
+	}
+
+	rb := RingBuffer{
+		buffer:       make([]bufferElement, slots),
+		clock:        clock.Real(),
+		slotDuration: time.Duration(seconds) * time.Second / time.Duration(slots),
+	}
+
+	for _, option := range options {
+		option(&rb)
+	}
+
+	rb.slotStart = rb.clock.Now()
+
+	return &rb
 }
 
 func (rb *RingBuffer) Insert(n float64) {
 	rb.mu.Lock()
 	defer rb.mu.Unlock()
 
-	rb.buffer[rb.pointer].val += n
-	rb.buffer[rb.pointer].insertCount++
+	rb.expire()
+	elem := &rb.buffer[rb.pointer]
+
+	if elem.insertCount == 0 || n < elem.min {
+		elem.min = n
+	}
+	if elem.insertCount == 0 || n > elem.max {
+		elem.max = n
+	}
+
+	elem.val += n
+	elem.insertCount++
+
+	if rb.percentiles {
+		elem.hist.insert(n)
+	}
 
 	rb.sum += n
 	rb.insertCount++
@@ -42,38 +113,112 @@ func (rb *RingBuffer) Average() float64 {
 	rb.mu.Lock()
 	defer rb.mu.Unlock()
 
+	rb.expire()
 	return rb.sum / float64(rb.insertCount)
 }
 
-func newWithChannel(seconds uint, c <-chan time.Time) *RingBuffer {
-	rb := RingBuffer{
-		buffer: make([]bufferElement, seconds),
+// Count returns the number of values inserted into the buffer that have not yet expired.
+func (rb *RingBuffer) Count() uint {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.expire()
+	return rb.insertCount
+}
+
+// Min returns the smallest value in the buffer. ok is false if the buffer is empty.
+func (rb *RingBuffer) Min() (min float64, ok bool) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.expire()
+
+	// Scanning the slots (rather than keeping a running minimum) means that
+	// the minimum is correct even after the slot that held it expires
+	for _, elem := range rb.buffer {
+		if elem.insertCount > 0 && (!ok || elem.min < min) {
+			min = elem.min
+			ok = true
+		}
 	}
 
-	go rb.run(c)
+	return min, ok
+}
 
-	return &rb
+// Max returns the largest value in the buffer. ok is false if the buffer is empty.
+func (rb *RingBuffer) Max() (max float64, ok bool) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.expire()
+
+	for _, elem := range rb.buffer {
+		if elem.insertCount > 0 && (!ok || elem.max > max) {
+			max = elem.max
+			ok = true
+		}
+	}
+
+	return max, ok
 }
 
-// Method to facilitate testing by allowing manual control of time steps
-func (rb *RingBuffer) run(c <-chan time.Time) {
-	for {
-		select {
-		case <-c:
-			rb.mu.Lock()
+// Percentile returns the approximate p-th percentile (0-100) of the values in the buffer.
+// The result is within 1% of a value in the buffer. ok is false if the buffer is empty
+// or was not created using WithPercentiles.
+func (rb *RingBuffer) Percentile(p float64) (float64, bool) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
 
-			rb.pointer += 1
-			if rb.pointer == uint(len(rb.buffer)) {
-				rb.pointer = 0
-			}
+	if !rb.percentiles {
+		return 0, false
+	}
 
-			rb.sum -= rb.buffer[rb.pointer].val
-			rb.insertCount -= rb.buffer[rb.pointer].insertCount
+	rb.expire()
 
-			rb.buffer[rb.pointer].val = 0
-			rb.buffer[rb.pointer].insertCount = 0
+	merged := histogram{}
+	for _, elem := range rb.buffer {
+		merged.merge(elem.hist)
+	}
 
-			rb.mu.Unlock()
-		}
+	return merged.percentile(p)
+}
+
+// expire moves forward one slot for each slot duration that has passed since the
+// current slot started, expiring the values in the slots it moves to.
+// Doing this lazily means that a RingBuffer needs no goroutine or ticker of its own.
+func (rb *RingBuffer) expire() {
+	elapsed := rb.clock.Now().Sub(rb.slotStart)
+	if elapsed < rb.slotDuration {
+		return
 	}
+
+	steps := uint64(elapsed / rb.slotDuration)
+	rb.slotStart = rb.slotStart.Add(time.Duration(steps) * rb.slotDuration)
+
+	// Past a full rotation, every slot has already been expired
+	if steps > uint64(len(rb.buffer)) {
+		steps = uint64(len(rb.buffer))
+	}
+
+	for i := uint64(0); i < steps; i++ {
+		rb.advance()
+	}
+}
+
+// advance moves to the next slot, expiring the values in it
+func (rb *RingBuffer) advance() {
+	rb.pointer += 1
+	if rb.pointer == uint(len(rb.buffer)) {
+		rb.pointer = 0
+	}
+
+	rb.sum -= rb.buffer[rb.pointer].val
+	rb.insertCount -= rb.buffer[rb.pointer].insertCount
+
+	// Avoid accumulating floating point error once the buffer is empty
+	if rb.insertCount == 0 {
+		rb.sum = 0
+	}
+
+	rb.buffer[rb.pointer] = bufferElement{}
 }
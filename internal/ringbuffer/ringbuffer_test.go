@@ -1,13 +1,16 @@
 package ringbuffer
 
 import (
+	"math"
 	"testing"
 	"time"
+
+	"github.com/sector-f/failoverd/internal/clock"
 )
 
 func TestSingleInsert(t *testing.T) {
-	ch := make(chan time.Time)
-	rb := newWithChannel(10, ch)
+	clk := clock.NewFake(time.Now())
+	rb := New(10, WithClock(clk))
 
 	rb.Insert(5)
 
@@ -18,8 +21,8 @@ func TestSingleInsert(t *testing.T) {
 }
 
 func TestManyInserts(t *testing.T) {
-	ch := make(chan time.Time)
-	rb := newWithChannel(10, ch)
+	clk := clock.NewFake(time.Now())
+	rb := New(10, WithClock(clk))
 
 	rb.Insert(5)
 	rb.Insert(5)
@@ -32,17 +35,17 @@ func TestManyInserts(t *testing.T) {
 }
 
 func TestManyInsertsIntoMultipleCells(t *testing.T) {
-	ch := make(chan time.Time)
-	rb := newWithChannel(10, ch)
+	clk := clock.NewFake(time.Now())
+	rb := New(10, WithClock(clk))
 
 	rb.Insert(5)
-	ch <- time.Now()
+	clk.Advance(1 * time.Second)
 
 	rb.Insert(5)
-	ch <- time.Now()
+	clk.Advance(1 * time.Second)
 
 	rb.Insert(5)
-	ch <- time.Now()
+	clk.Advance(1 * time.Second)
 
 	avg := rb.Average()
 	if avg != 5 {
@@ -51,11 +54,11 @@ func TestManyInsertsIntoMultipleCells(t *testing.T) {
 }
 
 func TestCircularOverwrite(t *testing.T) {
-	ch := make(chan time.Time)
-	rb := newWithChannel(1, ch)
+	clk := clock.NewFake(time.Now())
+	rb := New(1, WithClock(clk))
 
 	rb.Insert(1)
-	ch <- time.Now()
+	clk.Advance(1 * time.Second)
 	rb.Insert(2)
 
 	avg := rb.Average()
@@ -65,11 +68,11 @@ func TestCircularOverwrite(t *testing.T) {
 }
 
 func TestAvg(t *testing.T) {
-	ch := make(chan time.Time)
-	rb := newWithChannel(2, ch)
+	clk := clock.NewFake(time.Now())
+	rb := New(2, WithClock(clk))
 
 	rb.Insert(0)
-	ch <- time.Now()
+	clk.Advance(1 * time.Second)
 	rb.Insert(1)
 
 	avg := rb.Average()
@@ -77,3 +80,186 @@ func TestAvg(t *testing.T) {
 		t.Fatalf("Expected 0.5, got %v", avg)
 	}
 }
+
+func TestCount(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	rb := New(2, WithClock(clk))
+
+	rb.Insert(1)
+	rb.Insert(1)
+	clk.Advance(1 * time.Second)
+	rb.Insert(1)
+
+	count := rb.Count()
+	if count != 3 {
+		t.Fatalf("Expected 3, got %v", count)
+	}
+
+	clk.Advance(1 * time.Second)
+
+	count = rb.Count()
+	if count != 1 {
+		t.Fatalf("Expected 1, got %v", count)
+	}
+}
+
+func TestMinMaxExpire(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	rb := New(2, WithClock(clk))
+
+	rb.Insert(1)
+	rb.Insert(10)
+	clk.Advance(1 * time.Second)
+	rb.Insert(5)
+
+	min, _ := rb.Min()
+	max, _ := rb.Max()
+	if min != 1 || max != 10 {
+		t.Fatalf("Expected 1 and 10, got %v and %v", min, max)
+	}
+
+	// Expires the slot containing 1 and 10
+	clk.Advance(1 * time.Second)
+
+	min, _ = rb.Min()
+	max, _ = rb.Max()
+	if min != 5 || max != 5 {
+		t.Fatalf("Expected 5 and 5, got %v and %v", min, max)
+	}
+
+	clk.Advance(1 * time.Second)
+
+	_, ok := rb.Min()
+	if ok {
+		t.Fatalf("Expected empty buffer to have no minimum")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	rb := New(2, WithClock(clk), WithPercentiles())
+
+	for i := 1; i <= 100; i++ {
+		rb.Insert(float64(i))
+	}
+
+	for _, p := range []float64{50, 95, 99} {
+		v, ok := rb.Percentile(p)
+		if !ok || math.Abs(v-p)/p > 0.01 {
+			t.Fatalf("Expected p%v to be about %v, got %v", p, p, v)
+		}
+	}
+
+	clk.Advance(1 * time.Second)
+	rb.Insert(1000)
+	clk.Advance(1 * time.Second)
+
+	v, _ := rb.Percentile(50)
+	if math.Abs(v-1000)/1000 > 0.01 {
+		t.Fatalf("Expected p50 to be about 1000 after expiry, got %v", v)
+	}
+}
+
+func TestPercentileDisabled(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	rb := New(2, WithClock(clk))
+	rb.Insert(1)
+
+	_, ok := rb.Percentile(50)
+	if ok {
+		t.Fatalf("Expected percentiles to be unavailable")
+	}
+}
+
+func TestEWMA(t *testing.T) {
+	e := NewEWMA(0.5)
+
+	_, ok := e.Value()
+	if ok {
+		t.Fatalf("Expected empty EWMA to have no value")
+	}
+
+	e.Insert(10)
+	e.Insert(0)
+	e.Insert(0)
+
+	v, _ := e.Value()
+	if v != 2.5 {
+		t.Fatalf("Expected 2.5, got %v", v)
+	}
+}
+
+func TestExpireAfterLongPause(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	rb := New(3, WithClock(clk))
+
+	rb.Insert(1)
+	clk.Advance(1 * time.Second)
+	rb.Insert(2)
+	clk.Advance(1 * time.Hour)
+	rb.Insert(3)
+
+	count := rb.Count()
+	if count != 1 {
+		t.Fatalf("Expected 1, got %v", count)
+	}
+
+	avg := rb.Average()
+	if avg != 3 {
+		t.Fatalf("Expected 3, got %v", avg)
+	}
+}
+
+func TestResolution(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	rb := NewWithResolution(10, 2, WithClock(clk))
+
+	// Two slots of five seconds each
+	rb.Insert(1)
+	clk.Advance(4 * time.Second)
+	rb.Insert(1)
+	clk.Advance(1 * time.Second)
+	rb.Insert(1)
+	clk.Advance(5 * time.Second)
+
+	count := rb.Count()
+	if count != 1 {
+		t.Fatalf("Expected 1, got %v", count)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	rb := New(3, WithClock(clk), WithPercentiles())
+
+	rb.Insert(1)
+	clk.Advance(1 * time.Second)
+	rb.Insert(2)
+	rb.Insert(6)
+
+	state := rb.State()
+
+	// Restore into a new buffer a second later: the first value expires a second after that
+	clk.Advance(1 * time.Second)
+	restored := New(3, WithClock(clk), WithPercentiles())
+	if err := restored.Restore(state); err != nil {
+		t.Fatal(err)
+	}
+
+	if avg := restored.Average(); avg != 3 {
+		t.Fatalf("Expected 3, got %v", avg)
+	}
+
+	if max, _ := restored.Max(); max != 6 {
+		t.Fatalf("Expected 6, got %v", max)
+	}
+
+	clk.Advance(1 * time.Second)
+	if count := restored.Count(); count != 2 {
+		t.Fatalf("Expected 2, got %v", count)
+	}
+
+	if err := New(4, WithClock(clk)).Restore(state); err == nil {
+		t.Fatal("Expected an error restoring into a buffer of a different size")
+	}
+}
@@ -0,0 +1,107 @@
+package ringbuffer
+
+import (
+	"fmt"
+	"time"
+)
+
+// State is the contents of a RingBuffer. It can be saved, e.g. as JSON, and later restored
+// into a RingBuffer with the same length and resolution, such as after a restart.
+type State struct {
+	SlotDuration time.Duration `json:"slot_duration"`
+	SlotStart    time.Time     `json:"slot_start"` // When the newest slot started receiving values
+	Slots        []SlotState   `json:"slots"`      // Oldest first
+}
+
+// SlotState is the contents of a single slot of a RingBuffer.
+type SlotState struct {
+	Sum       float64      `json:"sum"`
+	Count     uint         `json:"count"`
+	Min       float64      `json:"min"`
+	Max       float64      `json:"max"`
+	Histogram map[int]uint `json:"histogram,omitempty"`
+}
+
+// State returns the contents of the buffer. Values that have expired are not included.
+func (rb *RingBuffer) State() State {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.expire()
+
+	s := State{
+		SlotDuration: rb.slotDuration,
+		SlotStart:    rb.slotStart,
+		Slots:        make([]SlotState, 0, len(rb.buffer)),
+	}
+
+	// The slot after the pointer is the oldest
+	for i := 1; i <= len(rb.buffer); i++ {
+		elem := rb.buffer[(int(rb.pointer)+i)%len(rb.buffer)]
+
+		slot := SlotState{
+			Sum:   elem.val,
+			Count: elem.insertCount,
+			Min:   elem.min,
+			Max:   elem.max,
+		}
+
+		if len(elem.hist) > 0 {
+			slot.Histogram = make(map[int]uint, len(elem.hist))
+			for bin, count := range elem.hist {
+				slot.Histogram[bin] = count
+			}
+		}
+
+		s.Slots = append(s.Slots, slot)
+	}
+
+	return s
+}
+
+// Restore replaces the contents of the buffer with a saved State. The State must come from a
+// RingBuffer with the same length and resolution. Values that have expired since the State was
+// saved are expired as usual, according to the buffer's clock.
+func (rb *RingBuffer) Restore(s State) error {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if s.SlotDuration != rb.slotDuration || len(s.Slots) != len(rb.buffer) {
+		return fmt.Errorf("state has %d slots of %s, but buffer has %d slots of %s",
+			len(s.Slots), s.SlotDuration, len(rb.buffer), rb.slotDuration)
+	}
+
+	// A state saved in the future (e.g. before the clock was set back) cannot be expired correctly
+	if s.SlotStart.After(rb.clock.Now()) {
+		return fmt.Errorf("state was saved after the current time")
+	}
+
+	rb.sum = 0
+	rb.insertCount = 0
+
+	// Put the newest slot at the pointer
+	for i, slot := range s.Slots {
+		elem := bufferElement{
+			val:         slot.Sum,
+			insertCount: slot.Count,
+			min:         slot.Min,
+			max:         slot.Max,
+		}
+
+		if rb.percentiles && len(slot.Histogram) > 0 {
+			elem.hist = make(histogram, len(slot.Histogram))
+			for bin, count := range slot.Histogram {
+				elem.hist[bin] = count
+			}
+		}
+
+		rb.buffer[(int(rb.pointer)+1+i)%len(rb.buffer)] = elem
+		rb.sum += slot.Sum
+		rb.insertCount += slot.Count
+	}
+
+	rb.slotStart = s.SlotStart
+	rb.expire()
+
+	return nil
+}
@@ -0,0 +1,76 @@
+// Package state saves failoverd's state to a file, so that it survives restarts.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sector-f/failoverd/internal/ping"
+)
+
+const (
+	DefaultMaxAge       = 10 * time.Minute
+	DefaultSaveInterval = 30 * time.Second
+)
+
+// State is everything failoverd saves across restarts.
+type State struct {
+	SavedAt time.Time                  `json:"saved_at"`
+	Probes  map[string]ping.ProbeState `json:"probes,omitempty"` // Mapped by destination
+	Values  map[string]interface{}     `json:"values,omitempty"` // Set by the configuration with state.set
+}
+
+// Load reads the state saved at path. ok is false, with no error, if there is no saved state or if
+// it was saved more than maxAge before now, in which case it is too old to be useful. A maxAge of
+// zero means that saved state never gets too old.
+func Load(path string, maxAge time.Duration, now time.Time) (s State, ok bool, err error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return State{}, false, nil
+	} else if err != nil {
+		return State{}, false, err
+	}
+
+	err = json.Unmarshal(b, &s)
+	if err != nil {
+		return State{}, false, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if maxAge > 0 && now.Sub(s.SavedAt) > maxAge {
+		return State{}, false, nil
+	}
+
+	return s, true, nil
+}
+
+// Save writes the state to path. The state is written to a temporary file which then replaces
+// path, so that a crash while saving never leaves a partially written state behind.
+func Save(path string, s State) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // Fails harmlessly once the file has been renamed
+
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
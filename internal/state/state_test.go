@@ -0,0 +1,75 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sector-f/failoverd/internal/ping"
+)
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	savedAt := time.Unix(1000, 0)
+
+	err := Save(path, State{
+		SavedAt: savedAt,
+		Probes:  map[string]ping.ProbeState{"192.168.0.1": {Sent: 5}},
+		Values:  map[string]interface{}{"active": "eth0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, ok, err := Load(path, time.Minute, savedAt.Add(30*time.Second))
+	if err != nil || !ok {
+		t.Fatalf("Expected state to be loaded, got %v, %v", ok, err)
+	}
+
+	if !s.SavedAt.Equal(savedAt) || s.Probes["192.168.0.1"].Sent != 5 || s.Values["active"] != "eth0" {
+		t.Fatalf("Unexpected state: %+v", s)
+	}
+
+	// Only the state file is left behind
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 file, got %d", len(entries))
+	}
+}
+
+func TestLoadTooOld(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	savedAt := time.Unix(1000, 0)
+
+	if err := Save(path, State{SavedAt: savedAt}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, ok, err := Load(path, time.Minute, savedAt.Add(2*time.Minute))
+	if err != nil || ok {
+		t.Fatalf("Expected old state to be ignored, got %v, %v", ok, err)
+	}
+
+	_, ok, err = Load(path, 0, savedAt.Add(24*time.Hour))
+	if err != nil || !ok {
+		t.Fatalf("Expected state to be loaded without a maximum age, got %v, %v", ok, err)
+	}
+}
+
+func TestLoadMissing(t *testing.T) {
+	_, ok, err := Load(filepath.Join(t.TempDir(), "state.json"), time.Minute, time.Now())
+	if err != nil || ok {
+		t.Fatalf("Expected no state and no error, got %v, %v", ok, err)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	os.WriteFile(path, []byte("{"), 0o644)
+
+	_, _, err := Load(path, time.Minute, time.Now())
+	if err == nil {
+		t.Fatal("Expected an error loading an invalid state file")
+	}
+}
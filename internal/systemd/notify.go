@@ -0,0 +1,108 @@
+// Package systemd implements the parts of the sd_notify protocol used by failoverd.
+
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notifier sends state updates to the service manager over the socket named by
+// the NOTIFY_SOCKET environment variable.
+type Notifier struct {
+	addr *net.UnixAddr
+}
+
+// NewNotifier returns a Notifier for the socket named by NOTIFY_SOCKET.
+// If the variable is unset, nil is returned; all methods are no-ops on a nil Notifier.
+func NewNotifier() *Notifier {
+	return newNotifier(os.Getenv("NOTIFY_SOCKET"))
+}
+
+func newNotifier(socket string) *Notifier {
+	if socket == "" {
+		return nil
+	}
+
+	// Abstract socket addresses are given with a leading '@'
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	return &Notifier{
+		addr: &net.UnixAddr{Name: socket, Net: "unixgram"},
+	}
+}
+
+// Notify sends the given newline-separated state assignments, e.g. "READY=1".
+func (n *Notifier) Notify(state string) error {
+	if n == nil {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, n.addr)
+	if err != nil {
+		return fmt.Errorf("could not connect to notify socket: %w", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return fmt.Errorf("could not write to notify socket: %w", err)
+	}
+
+	return nil
+}
+
+// Ready tells the service manager that startup has finished.
+func (n *Notifier) Ready() error {
+	return n.Notify("READY=1")
+}
+
+// Stopping tells the service manager that the service is shutting down.
+func (n *Notifier) Stopping() error {
+	return n.Notify("STOPPING=1")
+}
+
+// Status sets the free-form status string shown by `systemctl status`.
+func (n *Notifier) Status(status string) error {
+	// The protocol is newline-delimited, so the status must fit on one line
+	status = strings.ReplaceAll(status, "\n", " ")
+	return n.Notify("STATUS=" + status)
+}
+
+// Watchdog resets the service manager's watchdog timer.
+func (n *Notifier) Watchdog() error {
+	return n.Notify("WATCHDOG=1")
+}
+
+// WatchdogInterval returns the watchdog timeout configured via WatchdogSec=,
+// or 0 if the watchdog is not enabled for this process.
+func WatchdogInterval() time.Duration {
+	return watchdogInterval(os.Getenv("WATCHDOG_USEC"), os.Getenv("WATCHDOG_PID"), os.Getpid())
+}
+
+func watchdogInterval(usecStr string, pidStr string, pid int) time.Duration {
+	if usecStr == "" {
+		return 0
+	}
+
+	usec, err := strconv.ParseUint(usecStr, 10, 64)
+	if err != nil || usec == 0 {
+		return 0
+	}
+
+	// WATCHDOG_PID is optional, but if it is set it must refer to us
+	if pidStr != "" {
+		watchdogPid, err := strconv.Atoi(pidStr)
+		if err != nil || watchdogPid != pid {
+			return 0
+		}
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
@@ -0,0 +1,112 @@
+package systemd
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T) (*net.UnixConn, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn, path
+}
+
+func read(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(buf[:n])
+}
+
+func TestNilNotifier(t *testing.T) {
+	n := newNotifier("")
+	if n != nil {
+		t.Fatalf("Expected nil notifier")
+	}
+
+	err := n.Ready()
+	if err != nil {
+		t.Fatalf("Expected nil error, got %v", err)
+	}
+}
+
+func TestReady(t *testing.T) {
+	conn, path := listen(t)
+	n := newNotifier(path)
+
+	err := n.Ready()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := read(t, conn)
+	if msg != "READY=1" {
+		t.Fatalf("Expected READY=1, got %q", msg)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	conn, path := listen(t)
+	n := newNotifier(path)
+
+	err := n.Status("active: 192.168.0.1\nloss: 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := read(t, conn)
+	if msg != "STATUS=active: 192.168.0.1 loss: 0" {
+		t.Fatalf("Unexpected message %q", msg)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	conn, path := listen(t)
+	n := newNotifier(path)
+
+	err := n.Watchdog()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := read(t, conn)
+	if msg != "WATCHDOG=1" {
+		t.Fatalf("Expected WATCHDOG=1, got %q", msg)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		usec     string
+		pid      string
+		expected time.Duration
+	}{
+		{"", "", 0},
+		{"bogus", "", 0},
+		{"2000000", "", 2 * time.Second},
+		{"2000000", "100", 2 * time.Second},
+		{"2000000", "101", 0},
+	}
+
+	for _, test := range tests {
+		interval := watchdogInterval(test.usec, test.pid, 100)
+		if interval != test.expected {
+			t.Fatalf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: expected %v, got %v", test.usec, test.pid, test.expected, interval)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Package trace reads and writes recorded probe results as JSON Lines, one result per line.
+
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sector-f/failoverd/internal/ping"
+)
+
+// Record is the serialized form of a ping.Result.
+type Record struct {
+	Time    time.Time `json:"time"`
+	Probe   string    `json:"probe"` // Identifies the probe; currently its destination address
+	Src     string    `json:"src,omitempty"`
+	Dst     string    `json:"dst"`
+	Success bool      `json:"success"`
+	RTT     float64   `json:"rtt_ms,omitempty"` // Round-trip time in milliseconds
+	Error   string    `json:"error,omitempty"`
+}
+
+func FromResult(res ping.Result) Record {
+	rec := Record{
+		Time:    res.Time,
+		Probe:   res.Dst,
+		Src:     res.Src,
+		Dst:     res.Dst,
+		Success: res.Success,
+	}
+
+	if res.Success {
+		rec.RTT = float64(res.RTT) / float64(time.Millisecond)
+	} else if res.Err != nil {
+		rec.Error = res.Err.Error()
+	}
+
+	return rec
+}
+
+// Result converts the record back into a ping.Result.
+func (rec Record) Result() ping.Result {
+	res := ping.Result{
+		Time:    rec.Time,
+		Src:     rec.Src,
+		Dst:     rec.Dst,
+		Success: rec.Success,
+	}
+
+	if rec.Success {
+		res.RTT = time.Duration(rec.RTT * float64(time.Millisecond))
+	} else if rec.Error != "" {
+		res.Err = errors.New(rec.Error)
+	} else {
+		res.Err = ping.ErrNoResponse
+	}
+
+	return res
+}
+
+// Reader reads records from a trace.
+type Reader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		scanner: bufio.NewScanner(r),
+	}
+}
+
+// Next returns the next record in the trace. Blank lines are skipped.
+// It returns io.EOF once the end of the trace is reached.
+func (r *Reader) Next() (Record, error) {
+	for r.scanner.Scan() {
+		r.line++
+
+		line := r.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		rec := Record{}
+		err := json.Unmarshal(line, &rec)
+		if err != nil {
+			return Record{}, fmt.Errorf("line %d: %w", r.line, err)
+		}
+
+		if rec.Dst == "" {
+			return Record{}, fmt.Errorf("line %d: record has no destination", r.line)
+		}
+
+		return rec, nil
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return Record{}, err
+	}
+
+	return Record{}, io.EOF
+}
@@ -0,0 +1,67 @@
+package trace
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sector-f/failoverd/internal/ping"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	results := []ping.Result{
+		{Time: time.Unix(1000, 0).UTC(), Src: "10.0.0.2", Dst: "192.168.0.1", Success: true, RTT: 12500 * time.Microsecond},
+		{Time: time.Unix(1001, 0).UTC(), Dst: "192.168.0.1", Err: errors.New("network is unreachable")},
+	}
+
+	for _, res := range results {
+		actual := FromResult(res).Result()
+
+		if !actual.Time.Equal(res.Time) || actual.Src != res.Src || actual.Dst != res.Dst || actual.Success != res.Success || actual.RTT != res.RTT {
+			t.Fatalf("Expected %+v, got %+v", res, actual)
+		}
+
+		if (res.Err == nil) != (actual.Err == nil) || (res.Err != nil && res.Err.Error() != actual.Err.Error()) {
+			t.Fatalf("Expected error %v, got %v", res.Err, actual.Err)
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	input := `{"time":"2022-06-14T03:12:00Z","probe":"192.168.0.1","dst":"192.168.0.1","success":true,"rtt_ms":10}
+
+{"time":"2022-06-14T03:12:01Z","probe":"192.168.0.1","dst":"192.168.0.1","success":false}
+`
+
+	r := NewReader(strings.NewReader(input))
+
+	rec, err := r.Next()
+	if err != nil || !rec.Success || rec.RTT != 10 {
+		t.Fatalf("Unexpected first record %+v (%v)", rec, err)
+	}
+
+	rec, err = r.Next()
+	if err != nil || rec.Success {
+		t.Fatalf("Unexpected second record %+v (%v)", rec, err)
+	}
+
+	if rec.Result().Err != ping.ErrNoResponse {
+		t.Fatalf("Expected a failed record without an error to have ErrNoResponse")
+	}
+
+	_, err = r.Next()
+	if err != io.EOF {
+		t.Fatalf("Expected io.EOF, got %v", err)
+	}
+}
+
+func TestReaderError(t *testing.T) {
+	r := NewReader(strings.NewReader("{}\n"))
+
+	_, err := r.Next()
+	if err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Fatalf("Expected error on line 1, got %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	DefaultMaxSize  = 10 * 1024 * 1024 // 10 MiB
+	DefaultMaxFiles = 5
+)
+
+// Writer appends records to a trace file. Once the file would grow beyond its maximum size,
+// it is rotated: path is renamed to path.1, path.1 to path.2, and so on, keeping at most
+// maxFiles old files.
+type Writer struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	f    *os.File
+	size int64
+
+	mu sync.Mutex
+}
+
+// NewWriter opens (or creates) the trace file at path for appending.
+// If maxSize or maxFiles are not positive, DefaultMaxSize and DefaultMaxFiles are used.
+func NewWriter(path string, maxSize int64, maxFiles int) (*Writer, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+
+	if maxFiles <= 0 {
+		maxFiles = DefaultMaxFiles
+	}
+
+	w := &Writer{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+
+	err := w.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("could not open trace file: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("could not open trace file: %w", err)
+	}
+
+	w.f = f
+	w.size = info.Size()
+	return nil
+}
+
+func (w *Writer) Write(rec Record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.f == nil {
+		return fmt.Errorf("trace file is closed")
+	}
+
+	var rotateErr error
+	if w.size > 0 && w.size+int64(len(line)) > w.maxSize {
+		// If the file could not be rotated but is still open, the record is written to it anyway
+		rotateErr = w.rotate()
+		if w.f == nil {
+			return rotateErr
+		}
+	}
+
+	n, err := w.f.Write(line)
+	w.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("could not write to trace file: %w", err)
+	}
+
+	return rotateErr
+}
+
+// rotate renames the current file out of the way and opens a new one. If that fails,
+// the current file is reopened, so that records are still written to it.
+func (w *Writer) rotate() error {
+	err := w.f.Close()
+	w.f = nil
+	if err != nil {
+		return w.reopen(fmt.Errorf("could not close trace file: %w", err))
+	}
+
+	// Remove the oldest file and shift the rest up by one
+	os.Remove(w.rotatedPath(w.maxFiles))
+	for i := w.maxFiles - 1; i >= 1; i-- {
+		err := os.Rename(w.rotatedPath(i), w.rotatedPath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return w.reopen(fmt.Errorf("could not rotate trace file: %w", err))
+		}
+	}
+
+	err = os.Rename(w.path, w.rotatedPath(1))
+	if err != nil {
+		return w.reopen(fmt.Errorf("could not rotate trace file: %w", err))
+	}
+
+	return w.open()
+}
+
+// reopen reopens the current file after rotating it failed with rotateErr, which is returned
+func (w *Writer) reopen(rotateErr error) error {
+	err := w.open()
+	if err != nil {
+		return fmt.Errorf("%w; %w", rotateErr, err)
+	}
+
+	return rotateErr
+}
+
+func (w *Writer) rotatedPath(n int) string {
+	return fmt.Sprintf("%s.%d", w.path, n)
+}
+
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.f == nil {
+		return nil
+	}
+
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
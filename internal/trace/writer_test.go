@@ -0,0 +1,121 @@
+package trace
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readAll(t *testing.T, path string) []Record {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	records := []Record{}
+	r := NewReader(f)
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+
+	w, err := NewWriter(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := Record{Time: time.Unix(1000, 0).UTC(), Probe: "192.168.0.1", Dst: "192.168.0.1", Success: true, RTT: 10}
+	w.Write(rec)
+	w.Close()
+
+	// Reopening appends to the existing file
+	w, err = NewWriter(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(rec)
+	w.Close()
+
+	records := readAll(t, path)
+	if len(records) != 2 || records[0] != rec {
+		t.Fatalf("Expected 2 copies of %+v, got %+v", rec, records)
+	}
+}
+
+func TestWriterRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+
+	// Small enough that every record is written to a new file
+	w, err := NewWriter(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 4; i++ {
+		err := w.Write(Record{Time: time.Unix(int64(i), 0).UTC(), Dst: "192.168.0.1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]int64{
+		path:        3,
+		path + ".1": 2,
+		path + ".2": 1,
+	}
+	for p, sec := range expected {
+		records := readAll(t, p)
+		if len(records) != 1 || records[0].Time.Unix() != sec {
+			t.Fatalf("Expected %s to contain the record from %d, got %+v", p, sec, records)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("Expected only 2 rotated files to be kept")
+	}
+}
+
+func TestWriterRotationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+
+	// path.1 is a non-empty directory, so path cannot be renamed to it
+	err := os.MkdirAll(filepath.Join(path+".1", "dir"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewWriter(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for i := 0; i < 3; i++ {
+		err := w.Write(Record{Time: time.Unix(int64(i), 0).UTC(), Dst: "192.168.0.1"})
+		if i > 0 && err == nil {
+			t.Fatalf("Expected an error rotating the trace file")
+		}
+	}
+
+	// Records are still written to the current file once rotation has failed
+	records := readAll(t, path)
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %+v", records)
+	}
+}
@@ -3,68 +3,453 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/sector-f/failoverd/internal/clock"
+	"github.com/sector-f/failoverd/internal/control"
+	"github.com/sector-f/failoverd/internal/events"
+	"github.com/sector-f/failoverd/internal/logging"
 	"github.com/sector-f/failoverd/internal/lua"
 	"github.com/sector-f/failoverd/internal/ping"
+	"github.com/sector-f/failoverd/internal/state"
+	"github.com/sector-f/failoverd/internal/systemd"
+	"github.com/sector-f/failoverd/internal/trace"
 )
 
 func main() {
 	configFilename := flag.String("c", "config.lua", "Path to configuration Lua script")
+	simulateFilename := flag.String("simulate", "", "Replay the probe results in this trace file through the configuration script, and print a timeline of its decisions instead of running")
+	recordFilename := flag.String("record", "", "Record every probe result to this trace file (overrides \"record.path\")")
+	recordMaxSize := flag.Int64("record-max-size", 0, "Rotate the trace file once it reaches this many bytes (overrides \"record.max_size\")")
+	dryRun := flag.Bool("dry-run", false, "Report dry-run mode to the configuration script via failoverd.dry_run()")
+	dryRunExec := flag.Bool("dry-run-exec", false, "Like -dry-run, but also log commands passed to os.execute and the exec module, and requests made with the http module, instead of carrying them out")
+	sandbox := flag.Bool("sandbox", false, "Run the configuration script in a sandbox, without io, os.execute or file access")
+	sandboxModules := flag.String("sandbox-modules", strings.Join(lua.DefaultSandboxModules, ","), "Comma-separated list of modules that sandboxed scripts may require")
+	sandboxTimeout := flag.Duration("sandbox-timeout", lua.DefaultSandboxTimeout, "Abort sandboxed scripts, and each of their callbacks, after running this long (0 for no limit)")
+	sandboxMaxInstructions := flag.Uint64("sandbox-max-instructions", lua.DefaultSandboxMaxInstructions, "Abort sandboxed scripts, and each of their callbacks, after running this many Lua instructions (0 for no limit)")
+	sandboxMaxMemory := flag.Uint64("sandbox-max-memory", lua.DefaultSandboxMaxMemory, "Abort sandboxed scripts, and each of their callbacks, after allocating this many bytes (0 for no limit)")
+	check := flag.Bool("check", false, "Check the configuration, including whether probe interfaces exist, and exit")
+	logLevel := flag.String("log-level", "", "Log messages at this level and above: debug, info, warn or error (overrides \"logging.level\")")
+	logFormat := flag.String("log-format", "", "Log format on stderr: text or json (overrides \"logging.format\")")
+	stateFilename := flag.String("state", "", "Save probe statistics and state.set values to this file, and restore them on start (overrides \"state.path\")")
+	stateMaxAge := flag.Duration("state-max-age", state.DefaultMaxAge, "Do not restore state saved longer ago than this (0 for no limit; overrides \"state.max_age\")")
+	controlSocket := flag.String("control-socket", "", "Serve the event history and callback statistics on this unix socket (overrides \"control_socket\")")
+	logOutput := flag.String("log-output", "", "Where to log: stderr, syslog or journald (overrides \"logging.output\")")
 	flag.Parse()
 
-	luaEngine, err := lua.New(*configFilename)
+	// Set to exit with an error once everything has shut down. It is deferred first so that it runs
+	// after the other deferred functions, which os.Exit would skip.
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
+	// Until the configuration has been loaded, only the flags are known
+	logger, closeLogger, err := newLogger(lua.LoggingConfig{}, *logLevel, *logFormat, *logOutput)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+	defer func() { closeLogger() }() // closeLogger is replaced along with the logger
+
+	engineOptions := []lua.Option{lua.WithLogger(logger)}
+	if *sandbox {
+		modules := []string{}
+		for _, module := range strings.Split(*sandboxModules, ",") {
+			if module = strings.TrimSpace(module); module != "" {
+				modules = append(modules, module)
+			}
+		}
+
+		engineOptions = append(engineOptions, lua.WithSandbox(lua.Sandbox{
+			Modules:         modules,
+			Timeout:         *sandboxTimeout,
+			MaxInstructions: *sandboxMaxInstructions,
+			MaxMemory:       *sandboxMaxMemory,
+		}))
+	}
+
+	switch {
+	case *check:
+		// Checking should not have side effects, even if the script runs commands or makes requests at load time
+		engineOptions = append(engineOptions, lua.WithDryRun(true), lua.WithProbeChecks())
+	case *dryRun || *dryRunExec:
+		engineOptions = append(engineOptions, lua.WithDryRun(*dryRunExec))
+	}
+
+	// The script's timers run on the simulation's virtual clock, which starts at the beginning of the trace,
+	// and its commands and requests are written to the timeline instead of being carried out
+	var (
+		simulateClock    *clock.Fake
+		simulateTimeline *timeline
+	)
+	if *simulateFilename != "" {
+		start, err := traceStart(*simulateFilename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		simulateClock = clock.NewFake(start)
+		simulateTimeline = newTimeline(os.Stdout, simulateClock)
+		engineOptions = append(engineOptions, lua.WithClock(simulateClock), lua.WithInterceptor(simulateTimeline.action))
+	}
+
+	// Trial runs neither restore nor save state, so that they cannot disturb a running instance's
+	useState := !*check && *simulateFilename == "" && !*dryRun && !*dryRunExec
+
+	// A state file given on the command line is read before the script is loaded, so that the script
+	// can read its saved values at load time. One given by `state.path` is only known afterwards.
+	var restored state.State
+	if useState && *stateFilename != "" {
+		restored = loadState(logger, *stateFilename, *stateMaxAge, time.Now())
+		engineOptions = append(engineOptions, lua.WithRestoredValues(restored.Values))
+	}
+
+	luaEngine, err := lua.New(*configFilename, engineOptions...)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 	defer luaEngine.Close()
 
+	configLogger, closeConfigLogger, err := newLogger(luaEngine.Config.Logging, *logLevel, *logFormat, *logOutput)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	slog.SetDefault(configLogger)
+	luaEngine.SetLogger(configLogger)
+
+	// The logger used while loading the configuration is no longer needed
+	closeLogger()
+	logger, closeLogger = configLogger, closeConfigLogger
+
+	if luaEngine.Config.Record.Configured && luaEngine.Config.Record.Path == "" && *recordFilename == "" {
+		fmt.Fprintf(os.Stderr, "%s: `record` has no `path`, and -record was not given\n", *configFilename)
+		os.Exit(1)
+	}
+
+	if luaEngine.Config.State.Configured && luaEngine.Config.State.Path == "" && *stateFilename == "" {
+		fmt.Fprintf(os.Stderr, "%s: `state` has no `path`, and -state was not given\n", *configFilename)
+		os.Exit(1)
+	}
+
+	if *check {
+		fmt.Printf("%s: OK\n", *configFilename)
+		return
+	}
+
+	if *simulateFilename != "" {
+		err := simulate(luaEngine, simulateClock, *simulateFilename, simulateTimeline)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	clk := clock.Real()
+
 	config := luaEngine.Config
+
+	stateConfig := config.State
+	switch {
+	case !useState:
+		if stateConfig.Path != "" || *stateFilename != "" {
+			logger.Info("dry run; not restoring or saving state")
+		}
+		stateConfig.Path = ""
+	case *stateFilename != "":
+		stateConfig.Path = *stateFilename
+		stateConfig.MaxAge = *stateMaxAge
+	case stateConfig.Path != "":
+		restored = loadState(logger, stateConfig.Path, stateConfig.MaxAge, clk.Now())
+
+		err := luaEngine.RestoreValues(restored.Values)
+		if err != nil {
+			logger.Error("could not restore state values", "err", err)
+		}
+	}
+
 	p, err := ping.NewPinger(
 		config.Probes,
 		ping.WithPingFrequency(config.PingFrequency),
 		ping.WithNumSeconds(config.NumSeconds),
+		ping.WithWindows(config.Windows),
+		ping.WithEWMAAlpha(config.EWMAAlpha),
+		ping.WithClock(clk),
 		ping.WithPrivileged(config.Privileged),
+		ping.WithLogger(logger),
+		ping.WithRestoredState(restored.Probes),
 	)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
+	history := events.NewHistory(config.EventHistory)
+	recorder := newEventRecorder(history, p, clk, logger)
+	luaEngine.SetEventRecorder(recorder)
+	go recorder.deliver(luaEngine)
+
+	// The hooks must be set before the script can start and stop probes, e.g. from a timer
+	p.OnProbeStarted = func(probe ping.Probe) {
+		recorder.RecordEvent(events.ProbeStarted, probe.Dst, "")
+	}
+	p.OnProbeStopped = func(dst string) {
+		recorder.RecordEvent(events.ProbeStopped, dst, "")
+	}
+
 	luaEngine.SetPinger(p)
 
+	if !restored.SavedAt.IsZero() {
+		recorder.RecordEvent(events.StateRestored, "", "saved at "+restored.SavedAt.Format(time.RFC3339))
+	}
+
+	controlPath := config.ControlSocket
+	if *controlSocket != "" {
+		controlPath = *controlSocket
+	}
+
+	if controlPath != "" {
+		server, err := control.Listen(controlPath, map[string]control.Command{
+			"events": func() []interface{} {
+				values := []interface{}{}
+				for _, ev := range history.Events() {
+					values = append(values, ev)
+				}
+				return values
+			},
+			"callbacks": func() []interface{} {
+				return []interface{}{luaEngine.CallbackStats()}
+			},
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer server.Close()
+
+		go func() {
+			err := server.Serve()
+			if err != nil {
+				logger.Error("control socket failed", "path", controlPath, "err", err)
+			}
+		}()
+	}
+
+	record := config.Record
+	if *recordFilename != "" {
+		record.Path = *recordFilename
+	}
+	if *recordMaxSize > 0 {
+		record.MaxSize = *recordMaxSize
+	}
+
+	if record.Path != "" {
+		traceWriter, err := trace.NewWriter(record.Path, record.MaxSize, record.MaxFiles)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer traceWriter.Close()
+
+		p.OnResult = func(res ping.Result) {
+			err := traceWriter.Write(trace.FromResult(res))
+			if err != nil {
+				logger.Error("could not record probe result", "err", err)
+			}
+		}
+	}
+
+	notifier := systemd.NewNotifier()
+	var readyOnce sync.Once
+
 	p.OnRecv = func(ps ping.ProbeStats) {
 		err := luaEngine.OnRecv(p.Stats(), ps)
 		if err != nil {
-			log.Println(err)
+			logger.Error("callback failed", "callback", "on_recv", "dst", ps.Dst, "err", err)
+			recorder.RecordEvent(events.CallbackError, ps.Dst, err.Error())
 		}
+
+		// Startup is considered complete once the first probe result is in
+		readyOnce.Do(func() {
+			err := notifier.Ready()
+			if err != nil {
+				logger.Error("could not notify systemd", "err", err)
+			}
+		})
 	}
 
 	go p.Run()
 
+	// systemd stops units with SIGTERM, which must also save state and call on_quit
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
-	ticker := time.NewTicker(config.UpdateFrequency)
+	ticker := clk.NewTicker(config.UpdateFrequency)
+	defer ticker.Stop()
+
+	// If saving is disabled then saveC is nil, and its select case never fires
+	var saveC <-chan time.Time
+	saveState := func() {}
+	if stateConfig.Path != "" {
+		saveTicker := clk.NewTicker(stateConfig.SaveInterval)
+		defer saveTicker.Stop()
+		saveC = saveTicker.C()
+
+		saveState = func() {
+			values, err := luaEngine.Values()
+			if err != nil {
+				logger.Error("could not save state", "path", stateConfig.Path, "err", err)
+				return
+			}
+
+			err = state.Save(stateConfig.Path, state.State{
+				SavedAt: clk.Now(),
+				Probes:  p.State(),
+				Values:  values,
+			})
+			if err != nil {
+				logger.Error("could not save state", "path", stateConfig.Path, "err", err)
+			}
+		}
+	}
+
+	// The watchdog is pinged at half of its timeout, as recommended by sd_watchdog_enabled(3).
+	// If the watchdog is disabled then watchdogC is nil, and its select case never fires.
+	var watchdogC <-chan time.Time
+	watchdogInterval := systemd.WatchdogInterval()
+	if watchdogInterval > 0 {
+		watchdogTicker := clk.NewTicker(watchdogInterval / 2)
+		defer watchdogTicker.Stop()
+		watchdogC = watchdogTicker.C()
+	}
+
+loop:
 	for {
 		select {
-		case <-ticker.C:
-			err := luaEngine.OnUpdate(p.Stats())
+		case <-ticker.C():
+			stats := p.Stats()
+
+			err := luaEngine.OnUpdate(stats)
 			if err != nil {
-				log.Println(err)
+				logger.Error("callback failed", "callback", "on_update", "err", err)
+				recorder.RecordEvent(events.CallbackError, "", err.Error())
 			}
-		case <-sigChan:
-			err := luaEngine.OnQuit(p.Stats())
+
+			err = notifier.Status(statusLine(stats))
 			if err != nil {
-				log.Println(err)
+				logger.Error("could not notify systemd", "err", err)
+			}
+		case <-saveC:
+			saveState()
+		case <-watchdogC:
+			// Withhold the ping if the Pinger has stopped processing results, so that
+			// systemd restarts us. A probe that times out still produces a result, so
+			// silence for a whole watchdog interval means Run (or on_recv) is stuck.
+			lastRecv := p.LastRecv()
+			if !lastRecv.IsZero() && clk.Now().Sub(lastRecv) > watchdogInterval {
+				logger.Warn("no probe results received recently; withholding watchdog ping", "last_recv", lastRecv.Format(time.RFC3339))
+				continue
 			}
 
-			p.Stop()
-			return
+			err := notifier.Watchdog()
+			if err != nil {
+				logger.Error("could not notify systemd", "err", err)
+			}
+		case err := <-luaEngine.Fatal():
+			// Under the "exit" error policy; systemd's Restart= can bring us back
+			logger.Error("exiting after repeated callback errors", "err", err)
+			exitCode = 1
+			break loop
+		case <-sigChan:
+			break loop
 		}
 	}
+
+	notifier.Stopping()
+
+	err = luaEngine.OnQuit(p.Stats())
+	if err != nil {
+		logger.Error("callback failed", "callback", "on_quit", "err", err)
+		recorder.RecordEvent(events.CallbackError, "", err.Error())
+	}
+
+	p.Stop()
+	saveState()
+}
+
+// statusLine describes the current active uplink (the probe with the lowest loss) for `systemctl status`.
+func statusLine(gps ping.Snapshot) string {
+	best, ok := gps.LowestLoss()
+	if !ok {
+		return "Waiting for probe results"
+	}
+
+	return fmt.Sprintf("Active: %s (%.2f%% loss)", best.Dst, best.Loss)
+}
+
+// loadState loads the state saved at path, if it is recent enough. Since failoverd can run without it,
+// problems are logged and an empty State is returned.
+func loadState(logger *slog.Logger, path string, maxAge time.Duration, now time.Time) state.State {
+	s, ok, err := state.Load(path, maxAge, now)
+	switch {
+	case err != nil:
+		logger.Warn("could not load saved state; starting without it", "path", path, "err", err)
+		return state.State{}
+	case !ok:
+		logger.Info("no recent saved state; starting without it", "path", path)
+		return state.State{}
+	}
+
+	logger.Info("restoring saved state", "path", path, "saved_at", s.SavedAt.Format(time.RFC3339))
+	return s
+}
+
+// newLogger creates a logger using the `logging` settings, which are overridden by
+// the -log-level, -log-format and -log-output flags if they are given. The returned function
+// closes the logger's connection to syslog or journald, if it has one.
+func newLogger(lc lua.LoggingConfig, levelFlag string, formatFlag string, outputFlag string) (*slog.Logger, func(), error) {
+	if levelFlag != "" {
+		lc.Level = levelFlag
+	}
+	if formatFlag != "" {
+		lc.Format = formatFlag
+	}
+	if outputFlag != "" {
+		lc.Output = outputFlag
+	}
+
+	level := slog.LevelInfo
+	if lc.Level != "" {
+		var err error
+		level, err = logging.ParseLevel(lc.Level)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	h, err := logging.Open(lc.Output, level, lc.Format)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	closeFunc := func() {}
+	if c, ok := h.(io.Closer); ok {
+		closeFunc = func() { c.Close() }
+	}
+
+	return slog.New(h), closeFunc, nil
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sector-f/failoverd/internal/clock"
+	"github.com/sector-f/failoverd/internal/lua"
+	"github.com/sector-f/failoverd/internal/ping"
+	"github.com/sector-f/failoverd/internal/trace"
+)
+
+// traceStart returns the time of the first result in a trace, which simulations start at.
+func traceStart(traceFilename string) (time.Time, error) {
+	f, err := os.Open(traceFilename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	rec, err := trace.NewReader(f).Next()
+	if err == io.EOF {
+		return time.Time{}, fmt.Errorf("%s: trace is empty", traceFilename)
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s: %w", traceFilename, err)
+	}
+
+	return rec.Time, nil
+}
+
+// simulate replays the probe results recorded in a trace through the configuration script
+// under a virtual clock, which should start at traceStart and also be used by the Engine.
+// Instead of being carried out, the script's actions are written to tl, along with changes
+// to the lowest-loss probe and any callback errors. The Engine should be created with
+// lua.WithInterceptor(tl.action), so that its commands and requests are recorded too.
+func simulate(luaEngine *lua.Engine, clk *clock.Fake, traceFilename string, tl *timeline) error {
+	f, err := os.Open(traceFilename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := trace.NewReader(f)
+
+	rec, err := r.Next()
+	if err == io.EOF {
+		return fmt.Errorf("%s: trace is empty", traceFilename)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", traceFilename, err)
+	}
+
+	config := luaEngine.Config
+	p := ping.NewReplayPinger(
+		config.Probes,
+		ping.WithPingFrequency(config.PingFrequency),
+		ping.WithNumSeconds(config.NumSeconds),
+		ping.WithWindows(config.Windows),
+		ping.WithEWMAAlpha(config.EWMAAlpha),
+		ping.WithClock(clk),
+	)
+
+	luaEngine.SetPinger(&simulatedProbes{pinger: p, timeline: tl})
+
+	p.OnRecv = func(ps ping.ProbeStats) {
+		err := luaEngine.OnRecv(p.Stats(), ps)
+		if err != nil {
+			tl.event("error", "%v", err)
+		}
+	}
+
+	lastStatus := ""
+	update := func() {
+		stats := p.Stats()
+
+		err := luaEngine.OnUpdate(stats)
+		if err != nil {
+			tl.event("error", "%v", err)
+		}
+
+		status := statusLine(stats)
+		if status != lastStatus {
+			tl.event("status", "%s", status)
+			lastStatus = status
+		}
+	}
+
+	// on_update is called at fixed intervals from the start of the trace,
+	// interleaved with the recorded results
+	nextUpdate := rec.Time.Add(config.UpdateFrequency)
+	for {
+		for !nextUpdate.After(rec.Time) {
+			clk.Set(nextUpdate)
+			update()
+			nextUpdate = nextUpdate.Add(config.UpdateFrequency)
+		}
+
+		clk.Set(rec.Time)
+		p.Replay(rec.Result())
+
+		rec, err = r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", traceFilename, err)
+		}
+	}
+
+	err = luaEngine.OnQuit(p.Stats())
+	if err != nil {
+		tl.event("error", "%v", err)
+	}
+
+	return nil
+}
+
+// timeline writes timestamped simulation events. It is safe for concurrent use,
+// since async callbacks can run commands from their own goroutines.
+type timeline struct {
+	w     io.Writer
+	clock clock.Clock
+	mu    sync.Mutex
+}
+
+func newTimeline(w io.Writer, clk clock.Clock) *timeline {
+	return &timeline{w: w, clock: clk}
+}
+
+func (tl *timeline) event(kind string, format string, args ...interface{}) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	fmt.Fprintf(tl.w, "%s %-7s %s\n", tl.clock.Now().UTC().Format(time.RFC3339), kind, fmt.Sprintf(format, args...))
+}
+
+// action records a command or request intercepted by the Engine
+func (tl *timeline) action(action string) {
+	tl.event("action", "%s", action)
+}
+
+// simulatedProbes records the probes started and stopped by the script in the timeline.
+type simulatedProbes struct {
+	pinger   *ping.Pinger
+	timeline *timeline
+}
+
+func (s *simulatedProbes) StartProbe(probe ping.Probe) error {
+	if probe.Src != "" {
+		s.timeline.event("action", "probe.start %s (from %s)", probe.Dst, probe.Src)
+	} else {
+		s.timeline.event("action", "probe.start %s", probe.Dst)
+	}
+
+	return s.pinger.StartProbe(probe)
+}
+
+func (s *simulatedProbes) StopProbe(dst string) error {
+	s.timeline.event("action", "probe.stop %s", dst)
+	return s.pinger.StopProbe(dst)
+}
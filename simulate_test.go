@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sector-f/failoverd/internal/clock"
+	"github.com/sector-f/failoverd/internal/lua"
+)
+
+const simulateConfig = `
+ping_frequency = 1
+update_frequency = 2
+privileged = false
+num_seconds = 10
+probes = {
+	probe.new("192.168.0.1", {priority = 1}),
+	probe.new("192.168.0.2", {priority = 2}),
+}
+
+local exec = require("exec")
+
+function on_recv(gps, ps)
+	os.execute("echo recv " .. ps:dst())
+end
+
+function on_update(gps)
+	local best = gps:best()
+	if best:dst() ~= active then
+		active = best:dst()
+		exec.run({"ip", "route", "replace", "default", "via", active})
+	end
+end
+
+function on_quit(gps)
+	probe.stop("192.168.0.2")
+end
+`
+
+const simulateTrace = `{"time":"2022-06-14T03:10:00Z","probe":"192.168.0.1","dst":"192.168.0.1","success":true,"rtt_ms":10}
+{"time":"2022-06-14T03:10:00Z","probe":"192.168.0.2","dst":"192.168.0.2","success":true,"rtt_ms":20}
+{"time":"2022-06-14T03:10:01Z","probe":"192.168.0.1","dst":"192.168.0.1","success":true,"rtt_ms":10}
+{"time":"2022-06-14T03:10:02Z","probe":"192.168.0.1","dst":"192.168.0.1","success":false,"error":"no response"}
+{"time":"2022-06-14T03:10:03Z","probe":"192.168.0.1","dst":"192.168.0.1","success":false,"error":"no response"}
+{"time":"2022-06-14T03:10:04Z","probe":"192.168.0.1","dst":"192.168.0.1","success":false,"error":"no response"}
+`
+
+func TestSimulate(t *testing.T) {
+	dir := t.TempDir()
+
+	configFilename := filepath.Join(dir, "config.lua")
+	err := os.WriteFile(configFilename, []byte(simulateConfig), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traceFilename := filepath.Join(dir, "trace.jsonl")
+	err = os.WriteFile(traceFilename, []byte(simulateTrace), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start, err := traceStart(traceFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	clk := clock.NewFake(start)
+	tl := newTimeline(&out, clk)
+
+	luaEngine, err := lua.New(configFilename, lua.WithClock(clk), lua.WithInterceptor(tl.action))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer luaEngine.Close()
+
+	err = simulate(luaEngine, clk, traceFilename, tl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 192.168.0.1 is preferred until it loses a ping, after which it has
+	// a higher loss than 192.168.0.2
+	expected := strings.Join([]string{
+		"2022-06-14T03:10:00Z action  os.execute echo recv 192.168.0.1",
+		"2022-06-14T03:10:00Z action  os.execute echo recv 192.168.0.2",
+		"2022-06-14T03:10:01Z action  os.execute echo recv 192.168.0.1",
+		"2022-06-14T03:10:02Z action  exec.run ip route replace default via 192.168.0.1",
+		"2022-06-14T03:10:02Z status  Active: 192.168.0.1 (0.00% loss)",
+		"2022-06-14T03:10:02Z action  os.execute echo recv 192.168.0.1",
+		"2022-06-14T03:10:03Z action  os.execute echo recv 192.168.0.1",
+		"2022-06-14T03:10:04Z action  exec.run ip route replace default via 192.168.0.2",
+		"2022-06-14T03:10:04Z status  Active: 192.168.0.2 (0.00% loss)",
+		"2022-06-14T03:10:04Z action  os.execute echo recv 192.168.0.1",
+		"2022-06-14T03:10:04Z action  probe.stop 192.168.0.2",
+		"",
+	}, "\n")
+
+	if out.String() != expected {
+		t.Fatalf("Unexpected timeline:\n%s\nexpected:\n%s", out.String(), expected)
+	}
+}